@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -16,74 +19,133 @@ var InfluxEndpoint string
 var InfluxTags string
 
 func main() {
-	config := solarmon.NewConfig(InfluxEndpoint, InfluxTags, BuildTime, GitCommit)
-
-	fmt.Printf("%s: starting Solarmon ...\n", config.StartTime.Format("2006-01-02 15:04:05"))
-	fmt.Printf("%s: VER=%s\n", config.StartTime.Format("2006-01-02 15:04:05"), config.Version)
-	fmt.Printf("%s: HTTP=%s\n", config.StartTime.Format("2006-01-02 15:04:05"), config.HTTPListen)
-	fmt.Printf("%s: TAGS=%s\n", config.StartTime.Format("2006-01-02 15:04:05"), config.InfluxTags)
-	fmt.Printf("%s: INTERVAL=%s\n", config.StartTime.Format("2006-01-02 15:04:05"), config.ReadInterval)
-	fmt.Printf(
-		"%s: NIGHTMODE=%v, from=%v, to=%v\n",
-		config.StartTime.Format("2006-01-02 15:04:05"),
-		config.NMode,
-		config.NModeStart,
-		config.NModeEnd,
-	)
-
-	registers, err := solarmon.GetRegistersToRead(config)
+	config, err := solarmon.NewConfig(flag.CommandLine, os.Args[1:], InfluxEndpoint, InfluxTags, BuildTime, GitCommit)
 
-	if len(registers) < 1 {
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s: ERR: %s\n", time.Now().String(), err)
 		os.Exit(1)
 	}
 
-	modbusRTU, err := solarmon.NewModbusRTU(config)
+	if config.ShowVersion {
+		fmt.Printf("%s: %s \n", config.StartTime.Format("2006-01-02 15:04:05"), config.Version)
+		os.Exit(0)
+	}
+
+	if config.ListTTY {
+		os.Exit(listTTY())
+	}
+
+	if config.Profile == "list" {
+		for _, p := range solarmon.Profiles {
+			fmt.Printf("%-16s %s\n", p.Name, p.Description)
+		}
+		os.Exit(0)
+	}
 
+	logger, err := solarmon.NewLogger(config, os.Stderr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s: ERR: %s\n", time.Now().String(), err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	if config.Scan {
+		os.Exit(scan(config, logger))
+	}
+
+	logger.Info(
+		"starting Solarmon",
+		"version", config.Version,
+		"http", config.HTTPListen,
+		"tags", config.InfluxTags,
+		"interval", config.ReadInterval.String(),
+		"nightmode", config.NMode,
+		"nightmode_from", config.NModeStart,
+		"nightmode_to", config.NModeEnd,
+	)
+
+	poller, err := solarmon.NewPoller(solarmon.Options{Config: config, Logger: logger})
+
+	if err != nil {
+		logger.Error("unable to start", "err", err)
 		os.Exit(2)
 	}
 
-	outputs := solarmon.GetOutputs(config)
+	if config.Profile != "" {
+		logger.Info("registers selected", "profile", config.Profile)
+	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	runErr := poller.Run(ctx)
+	stop()
 
-	go func() {
-		<-sigs
-		fmt.Printf("%s: stopping Solarmon ...\n\n", time.Now().Format("2006-01-02 15:04:05"))
-		modbusRTU.Close()
-		os.Exit(0)
-	}()
-
-	for {
-		t0 := time.Now()
-		// No need of empty values during the night
-		if config.NMode && (t0.Hour() >= config.NModeStart || t0.Hour() <= config.NModeEnd) && !config.Once {
-			solarmon.WriteToAllOutputs(
-				outputs,
-				fmt.Sprintf("Nightmode from %d to %d", config.NModeStart, config.NModeEnd),
-			)
-			time.Sleep(config.NModeSleepInterval)
-			continue
-		}
+	logger.Info("stopping Solarmon")
 
-		for _, r := range registers {
-			r.ReadHR(modbusRTU)
-		}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := poller.Shutdown(shutdownCtx); err != nil {
+		logger.Error("shutdown incomplete", "err", err)
+	}
+
+	if runErr != nil {
+		logger.Error("last cycle failed", "err", runErr)
+		cancel()
+		os.Exit(3)
+	}
+}
 
-		t1 := time.Now()
-		solarmon.WriteToAllOutputs(outputs, registers)
-		t2 := time.Now()
+func scan(config *solarmon.Config, logger *slog.Logger) int {
+	logger = solarmon.ComponentLogger(logger, solarmon.LogBus)
 
-		duration := fmt.Sprintf("%s, %s; **\n", fmt.Sprint(t1.Sub(t0)), fmt.Sprint(t2.Sub(t1)))
-		solarmon.WriteToAllOutputs(outputs, duration)
+	opts, err := solarmon.NewScanOptions(config)
+	if err != nil {
+		logger.Error("invalid scan options", "err", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-		if config.Once {
-			sigs <- syscall.SIGINT
+	logf := func(format string, args ...interface{}) {
+		logger.Info(fmt.Sprintf(format, args...))
+	}
+
+	devices, scanErr := solarmon.Scan(ctx, config, opts, logf)
+	if scanErr != nil {
+		logger.Error("scan failed", "err", scanErr)
+	}
+
+	out := os.Stdout
+	if config.ScanOut != "" {
+		out, err = os.Create(config.ScanOut)
+		if err != nil {
+			logger.Error("unable to create the draft rfile", "err", err)
+			return 1
 		}
+		defer out.Close()
+	}
+
+	if err := solarmon.WriteDraftRfile(out, devices); err != nil {
+		logger.Error("unable to write the draft rfile", "err", err)
+		return 1
+	}
+
+	if scanErr != nil || len(devices) == 0 {
+		return 2
+	}
+	return 0
+}
+
+func listTTY() int {
+	candidates, err := solarmon.ListTTYCandidates()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: ERR: %s\n", time.Now().String(), err)
+		return 1
+	}
 
-		time.Sleep(config.ReadInterval)
+	for _, c := range candidates {
+		fmt.Println(c)
 	}
+	return 0
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tolivb/go-mbpool/pkg/mbsim"
+)
+
+func main() {
+	mapFiles := flag.String("map", "configs/ktl33.json,configs/ktl33.alarms.json", "Register maps: ktl33.json style json or rfiles, comma separated")
+	scriptFile := flag.String("script", "", "Signal script, the built-in 30kW sunny day when empty")
+	tcpListen := flag.String("tcp", "", "Serve Modbus TCP on this addr, e.g. :5020")
+	ptyLink := flag.String("pty", "", "Serve Modbus RTU on a pseudo terminal, symlinked at this path, e.g. /tmp/ttySIM0")
+	slaveID := flag.Uint("slaveId", 1, "RTU slave ID")
+	tick := flag.Duration("tick", time.Second, "How often the values are recomputed")
+	files := flag.String("file", "", "Serve files to Huawei 0x41 uploads, type=path comma separated, e.g. 0x44=history.bin")
+	at := flag.String("at", "", "Pin the simulated clock to this time of today, e.g. 12:30")
+	flag.Parse()
+
+	if *tcpListen == "" && *ptyLink == "" {
+		fail(fmt.Errorf("nothing to serve, set -tcp and/or -pty"))
+	}
+
+	var registers []*mbsim.Register
+	for _, file := range strings.Split(*mapFiles, ",") {
+		var regs []*mbsim.Register
+		var err error
+		if strings.HasSuffix(file, ".json") {
+			regs, err = mbsim.LoadJSON(file)
+		} else {
+			regs, err = mbsim.LoadRfile(file)
+		}
+		if err != nil {
+			fail(err)
+		}
+		registers = append(registers, regs...)
+	}
+
+	var script io.Reader = strings.NewReader(mbsim.DefaultScript)
+	if *scriptFile != "" {
+		f, err := os.Open(*scriptFile)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		script = f
+	}
+
+	signals, err := mbsim.ParseScript(script)
+	if err != nil {
+		fail(err)
+	}
+
+	m := mbsim.NewMap(registers)
+	unused := m.Apply(signals)
+	if *scriptFile != "" && len(unused) > 0 {
+		logf("script entries matching no register: %s", strings.Join(unused, ", "))
+	}
+
+	if *files != "" {
+		for _, entry := range strings.Split(*files, ",") {
+			kv := strings.SplitN(entry, "=", 2)
+			fileType, err := strconv.ParseUint(kv[0], 0, 8)
+			if err != nil || len(kv) != 2 {
+				fail(fmt.Errorf("invalid -file entry %q, want type=path", entry))
+			}
+			content, err := ioutil.ReadFile(kv[1])
+			if err != nil {
+				fail(err)
+			}
+			m.AddFile(byte(fileType), content)
+		}
+	}
+
+	now := time.Now
+	if *at != "" {
+		pinned, err := time.ParseInLocation("15:04", *at, time.Local)
+		if err != nil {
+			fail(err)
+		}
+		y, mo, d := time.Now().Date()
+		start := time.Date(y, mo, d, pinned.Hour(), pinned.Minute(), 0, 0, time.Local)
+		offset := time.Until(start)
+		now = func() time.Time { return time.Now().Add(offset) }
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	m.Update(now())
+	go func() {
+		t := time.NewTicker(*tick)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				m.Update(now())
+			}
+		}
+	}()
+
+	errs := make(chan error, 2)
+
+	if *tcpListen != "" {
+		ln, err := net.Listen("tcp", *tcpListen)
+		if err != nil {
+			fail(err)
+		}
+		logf("serving modbus tcp on %s", ln.Addr())
+		go func() { errs <- mbsim.ServeTCP(ctx, ln, m) }()
+	}
+
+	if *ptyLink != "" {
+		pty, err := mbsim.OpenPTY()
+		if err != nil {
+			fail(err)
+		}
+		defer pty.Close()
+
+		os.Remove(*ptyLink)
+		if err := os.Symlink(pty.Name, *ptyLink); err != nil {
+			fail(err)
+		}
+		defer os.Remove(*ptyLink)
+
+		logf("serving modbus rtu slaveId=%d on %s -> %s", *slaveID, *ptyLink, pty.Name)
+		go func() { errs <- mbsim.ServeRTU(ctx, pty.Master, byte(*slaveID), m) }()
+	}
+
+	select {
+	case <-ctx.Done():
+	case err := <-errs:
+		if err != nil {
+			logf("ERR: %s", err)
+		}
+	}
+	logf("stopping simulator ...")
+}
+
+func logf(format string, args ...interface{}) {
+	fmt.Printf("%s: %s\n", time.Now().Format("2006-01-02 15:04:05"), fmt.Sprintf(format, args...))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "%s: ERR: %s\n", time.Now().String(), err)
+	os.Exit(1)
+}
@@ -1,8 +1,8 @@
 module github.com/tolivb/go-mbpool
 
-go 1.13
+go 1.21
 
 require (
 	github.com/goburrow/modbus v0.1.0
-	github.com/goburrow/serial v0.1.0 // indirect
+	github.com/goburrow/serial v0.1.0
 )
@@ -0,0 +1,68 @@
+package mbsim
+
+import "encoding/binary"
+
+const (
+	fcHuaweiExtended = 0x41
+
+	uploadStart    = 0x05
+	uploadData     = 0x06
+	uploadComplete = 0x0C
+
+	uploadFrameSize = 240
+)
+
+// AddFile serves content to Huawei 0x41 file uploads of fileType.
+func (m *Map) AddFile(fileType byte, content []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.files == nil {
+		m.files = make(map[byte][]byte)
+	}
+	m.files[fileType] = content
+}
+
+// handleUpload answers the start, data and complete sub-functions of a
+// file upload, data is the request after the function code.
+func (m *Map) handleUpload(data []byte) []byte {
+	if len(data) < 3 || int(data[1]) != len(data)-2 {
+		return exception(fcHuaweiExtended, exIllegalDataValue)
+	}
+
+	m.mutex.Lock()
+	file, ok := m.files[data[2]]
+	m.mutex.Unlock()
+	if !ok {
+		return exception(fcHuaweiExtended, exIllegalDataAddress)
+	}
+
+	sub, fileType := data[0], data[2]
+	var resp []byte
+	switch sub {
+	case uploadStart:
+		resp = []byte{fileType, 0, 0, 0, 0, uploadFrameSize}
+		binary.BigEndian.PutUint32(resp[1:], uint32(len(file)))
+	case uploadData:
+		if len(data) != 5 {
+			return exception(fcHuaweiExtended, exIllegalDataValue)
+		}
+		frame := int(binary.BigEndian.Uint16(data[3:]))
+		start := frame * uploadFrameSize
+		if start >= len(file) {
+			return exception(fcHuaweiExtended, exIllegalDataAddress)
+		}
+		end := start + uploadFrameSize
+		if end > len(file) {
+			end = len(file)
+		}
+		resp = append([]byte{fileType, data[3], data[4]}, file[start:end]...)
+	case uploadComplete:
+		resp = []byte{fileType, 0, 0}
+		binary.BigEndian.PutUint16(resp[1:], crc16(file))
+	default:
+		return exception(fcHuaweiExtended, exIllegalFunction)
+	}
+
+	return append([]byte{fcHuaweiExtended, sub, byte(len(resp))}, resp...)
+}
@@ -0,0 +1,274 @@
+// Package mbsim simulates a Modbus slave serving a register map with
+// scripted values, over Modbus TCP or RTU on a pseudo terminal.
+package mbsim
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	exIllegalFunction    = 1
+	exIllegalDataAddress = 2
+	exIllegalDataValue   = 3
+)
+
+// Register is one value of the map, spanning Quantity words from Addr.
+type Register struct {
+	Name     string
+	Type     string
+	Unit     string
+	Gain     float64
+	Addr     uint16
+	Quantity uint16
+	signal   *Signal
+}
+
+// Map holds the words served to clients. Addresses outside any register
+// answer with an illegal data address exception, like a real inverter.
+type Map struct {
+	mutex     *sync.Mutex
+	registers []*Register
+	words     map[uint16]uint16
+	files     map[byte][]byte
+}
+
+func NewMap(registers []*Register) *Map {
+	m := &Map{mutex: &sync.Mutex{}, registers: registers, words: make(map[uint16]uint16)}
+	for _, r := range registers {
+		for i := uint16(0); i < r.Quantity; i++ {
+			m.words[r.Addr+i] = 0
+		}
+	}
+	return m
+}
+
+// Apply attaches the script signals to the registers they name, by
+// register name (case insensitive, without '*') or by address. It returns
+// the script keys that matched no register.
+func (m *Map) Apply(signals map[string]*Signal) []string {
+	used := make(map[string]bool)
+	for _, r := range m.registers {
+		for _, key := range []string{strconv.Itoa(int(r.Addr)), normalizeName(r.Name)} {
+			if s, ok := signals[key]; ok {
+				r.signal = s
+				used[key] = true
+			}
+		}
+	}
+
+	var unused []string
+	for key := range signals {
+		if !used[key] {
+			unused = append(unused, key)
+		}
+	}
+	return unused
+}
+
+// Update evaluates the signals for t and encodes them into the words.
+func (m *Map) Update(t time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, r := range m.registers {
+		if r.signal == nil {
+			continue
+		}
+		for i, w := range encode(r, r.signal, t) {
+			m.words[r.Addr+uint16(i)] = w
+		}
+	}
+}
+
+func (m *Map) Read(addr, quantity uint16) ([]uint16, byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	words := make([]uint16, 0, quantity)
+	for i := uint32(0); i < uint32(quantity); i++ {
+		if uint32(addr)+i > 0xFFFF {
+			return nil, exIllegalDataAddress
+		}
+		w, ok := m.words[uint16(uint32(addr)+i)]
+		if !ok {
+			return nil, exIllegalDataAddress
+		}
+		words = append(words, w)
+	}
+	return words, 0
+}
+
+func (m *Map) Write(addr uint16, values []uint16) byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := range values {
+		if _, ok := m.words[addr+uint16(i)]; !ok {
+			return exIllegalDataAddress
+		}
+	}
+	for i, v := range values {
+		m.words[addr+uint16(i)] = v
+	}
+	return 0
+}
+
+func encode(r *Register, s *Signal, t time.Time) []uint16 {
+	words := make([]uint16, r.Quantity)
+
+	if r.Type == "STR" {
+		b := make([]byte, int(r.Quantity)*2)
+		copy(b, s.Text)
+		for i := range words {
+			words[i] = binary.BigEndian.Uint16(b[i*2:])
+		}
+		return words
+	}
+
+	gain := r.Gain
+	if gain == 0 {
+		gain = 1
+	}
+	raw := math.Round(s.Value(t) * gain)
+
+	var v uint32
+	switch r.Type {
+	case "I16":
+		v = uint32(uint16(int16(clamp(raw, math.MinInt16, math.MaxInt16))))
+	case "U16":
+		v = uint32(uint16(clamp(raw, 0, math.MaxUint16)))
+	case "I32":
+		v = uint32(int32(clamp(raw, math.MinInt32, math.MaxInt32)))
+	default:
+		v = uint32(clamp(raw, 0, math.MaxUint32))
+	}
+
+	if r.Quantity >= 2 {
+		words[0] = uint16(v >> 16)
+		words[1] = uint16(v)
+	} else if r.Quantity == 1 {
+		words[0] = uint16(v)
+	}
+	return words
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Trim(name, "* "))
+}
+
+// LoadJSON reads a register definition in the configs/ktl33.json layout,
+// or the alarm_registers of configs/ktl33.alarms.json.
+func LoadJSON(file string) ([]*Register, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var def struct {
+		Registers      [][]interface{} `json:"registers"`
+		AlarmRegisters [][]interface{} `json:"alarm_registers"`
+	}
+	if err := json.Unmarshal(content, &def); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", file, err)
+	}
+
+	var registers []*Register
+	for _, row := range def.Registers {
+		// SN, Signal Name, Read/Write, Type, Unit, Gain, Address, Quantity
+		if len(row) < 8 {
+			return nil, fmt.Errorf("%s: short register row %v", file, row)
+		}
+		r := &Register{
+			Name:     fmt.Sprint(row[1]),
+			Type:     fmt.Sprint(row[3]),
+			Unit:     fmt.Sprint(row[4]),
+			Gain:     number(row[5]),
+			Addr:     uint16(number(row[6])),
+			Quantity: uint16(number(row[7])),
+		}
+		registers = append(registers, r)
+	}
+
+	seen := make(map[uint16]bool)
+	for _, row := range def.AlarmRegisters {
+		// SN, Address, Bit, Parent Alarm Name, ...
+		if len(row) < 2 {
+			continue
+		}
+		addr := uint16(number(row[1]))
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		registers = append(registers, &Register{Name: fmt.Sprintf("alarm%d", addr), Type: "U16", Gain: 1, Addr: addr, Quantity: 1})
+	}
+
+	return registers, nil
+}
+
+// LoadRfile reads the registers of a go-mbpool rfile.
+func LoadRfile(file string) ([]*Register, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRfile(string(content))
+}
+
+func ParseRfile(content string) ([]*Register, error) {
+	var registers []*Register
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 1 || line[:1] == "#" {
+			continue
+		}
+
+		//register_id:total_bytes_toread:short_name:gain:register_type:unit
+		rinfo := strings.Split(line, ":")
+		if len(rinfo) < 6 {
+			continue
+		}
+
+		addr, err := strconv.ParseUint(rinfo[0], 10, 16)
+		if err != nil {
+			// not a bus register
+			continue
+		}
+		cnt, err := strconv.ParseUint(rinfo[1], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		gain, err := strconv.ParseFloat(rinfo[3], 64)
+		if err != nil {
+			return nil, err
+		}
+
+		registers = append(registers, &Register{
+			Name: rinfo[2], Gain: gain, Type: rinfo[4], Unit: rinfo[5], Addr: uint16(addr), Quantity: uint16(cnt),
+		})
+	}
+	return registers, nil
+}
+
+func number(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case string:
+		f, _ := strconv.ParseFloat(n, 64)
+		return f
+	}
+	return 0
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package mbsim
+
+import (
+	"errors"
+	"os"
+)
+
+type PTY struct {
+	Master *os.File
+	Name   string
+}
+
+func OpenPTY() (*PTY, error) {
+	return nil, errors.New("pseudo terminals are only supported on linux")
+}
+
+func (p *PTY) Close() error {
+	return nil
+}
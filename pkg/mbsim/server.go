@@ -0,0 +1,243 @@
+package mbsim
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	fcReadHoldingRegisters   = 3
+	fcReadInputRegisters     = 4
+	fcWriteSingleRegister    = 6
+	fcWriteMultipleRegisters = 16
+)
+
+// HandlePDU answers a request PDU (function code + data) from the map.
+func (m *Map) HandlePDU(pdu []byte) []byte {
+	if len(pdu) < 1 {
+		return nil
+	}
+
+	fc := pdu[0]
+	data := pdu[1:]
+
+	switch fc {
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+		if len(data) != 4 {
+			return exception(fc, exIllegalDataValue)
+		}
+		addr := binary.BigEndian.Uint16(data)
+		qty := binary.BigEndian.Uint16(data[2:])
+		if qty < 1 || qty > 125 {
+			return exception(fc, exIllegalDataValue)
+		}
+
+		words, ex := m.Read(addr, qty)
+		if ex != 0 {
+			return exception(fc, ex)
+		}
+
+		resp := make([]byte, 2+2*len(words))
+		resp[0] = fc
+		resp[1] = byte(2 * len(words))
+		for i, w := range words {
+			binary.BigEndian.PutUint16(resp[2+2*i:], w)
+		}
+		return resp
+
+	case fcWriteSingleRegister:
+		if len(data) != 4 {
+			return exception(fc, exIllegalDataValue)
+		}
+		if ex := m.Write(binary.BigEndian.Uint16(data), []uint16{binary.BigEndian.Uint16(data[2:])}); ex != 0 {
+			return exception(fc, ex)
+		}
+		return append([]byte{fc}, data...)
+
+	case fcWriteMultipleRegisters:
+		if len(data) < 5 {
+			return exception(fc, exIllegalDataValue)
+		}
+		addr := binary.BigEndian.Uint16(data)
+		qty := binary.BigEndian.Uint16(data[2:])
+		if int(data[4]) != int(qty)*2 || len(data) != 5+int(qty)*2 {
+			return exception(fc, exIllegalDataValue)
+		}
+
+		values := make([]uint16, qty)
+		for i := range values {
+			values[i] = binary.BigEndian.Uint16(data[5+2*i:])
+		}
+		if ex := m.Write(addr, values); ex != 0 {
+			return exception(fc, ex)
+		}
+		return append([]byte{fc}, data[:4]...)
+
+	case fcHuaweiExtended:
+		return m.handleUpload(data)
+	}
+
+	return exception(fc, exIllegalFunction)
+}
+
+func exception(fc, code byte) []byte {
+	return []byte{fc | 0x80, code}
+}
+
+// ServeTCP answers Modbus TCP requests on ln until ctx is done, the unit
+// identifier is ignored.
+func ServeTCP(ctx context.Context, ln net.Listener, m *Map) error {
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			go func() {
+				<-ctx.Done()
+				conn.Close()
+			}()
+			serveTCPConn(conn, m)
+		}()
+	}
+}
+
+func serveTCPConn(conn net.Conn, m *Map) {
+	r := bufio.NewReader(conn)
+	header := make([]byte, 7)
+
+	for {
+		// transaction id, protocol id, length, unit id
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if length < 2 || length > 254 {
+			return
+		}
+
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(r, pdu); err != nil {
+			return
+		}
+
+		resp := m.HandlePDU(pdu)
+		adu := make([]byte, 7+len(resp))
+		copy(adu, header[:4])
+		binary.BigEndian.PutUint16(adu[4:], uint16(len(resp)+1))
+		adu[6] = header[6]
+		copy(adu[7:], resp)
+
+		if _, err := conn.Write(adu); err != nil {
+			return
+		}
+	}
+}
+
+// ServeRTU answers RTU frames addressed to slaveID read from rw until it
+// fails or ctx is done. Frames are delimited by their function code
+// rather than by line silence, bytes that do not form a valid frame are
+// dropped one at a time until the stream resynchronises.
+func ServeRTU(ctx context.Context, rw io.ReadWriter, slaveID byte, m *Map) error {
+	buf := make([]byte, 0, 512)
+	chunk := make([]byte, 256)
+
+	for ctx.Err() == nil {
+		n, err := rw.Read(chunk)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		buf = append(buf, chunk[:n]...)
+
+		for {
+			size, ok := rtuFrameSize(buf)
+			if !ok {
+				buf = buf[1:]
+				continue
+			}
+			if size == 0 || len(buf) < size {
+				break
+			}
+
+			frame := buf[:size]
+			if crc16(frame[:size-2]) != binary.LittleEndian.Uint16(frame[size-2:]) {
+				buf = buf[1:]
+				continue
+			}
+
+			if frame[0] == slaveID {
+				resp := append([]byte{slaveID}, m.HandlePDU(frame[1:size-2])...)
+				resp = append(resp, 0, 0)
+				binary.LittleEndian.PutUint16(resp[len(resp)-2:], crc16(resp[:len(resp)-2]))
+				if _, err := rw.Write(resp); err != nil {
+					return err
+				}
+			}
+			buf = append(buf[:0], buf[size:]...)
+		}
+	}
+	return nil
+}
+
+// rtuFrameSize returns the length of the request frame at the start of buf,
+// 0 when more bytes are needed to tell, and false for an unknown function.
+func rtuFrameSize(buf []byte) (int, bool) {
+	if len(buf) < 2 {
+		return 0, true
+	}
+
+	switch buf[1] {
+	case fcReadHoldingRegisters, fcReadInputRegisters, fcWriteSingleRegister:
+		return 8, true
+	case fcWriteMultipleRegisters:
+		if len(buf) < 7 {
+			return 0, true
+		}
+		return 9 + int(buf[6]), true
+	case fcHuaweiExtended:
+		if len(buf) < 4 {
+			return 0, true
+		}
+		return 6 + int(buf[3]), true
+	}
+	return 0, false
+}
+
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,238 @@
+package mbsim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signal produces the value of a register over time.
+type Signal struct {
+	Text  string
+	value func(t time.Time) float64
+}
+
+func (s *Signal) Value(t time.Time) float64 {
+	if s.value == nil {
+		return 0
+	}
+	return s.value(t)
+}
+
+// ParseScript reads "key = kind args..." lines, key being a register name
+// or address. Kinds:
+//
+//	const V                      fixed value
+//	random MIN MAX               uniform noise
+//	sine MIN MAX PERIOD          e.g. sine 25 45 24h
+//	daycurve PEAK [RISE SET]     sin² shaped production between RISE and SET hour (6, 20)
+//	energy PEAK [RISE SET]       today's integral of the matching daycurve, kWh for a kW PEAK
+//	total PEAK BASE [RISE SET]   BASE + daily energy for every day since 2020-01-01 + today
+//	bits MASK PERIOD             MASK during odd periods, 0 otherwise, e.g. bits 0x0004 10m
+//	clock                        unix time
+//	str TEXT                     for STR registers
+func ParseScript(r io.Reader) (map[string]*Signal, error) {
+	signals := make(map[string]*Signal)
+	scanner := bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("script line %d: missing '='", n)
+		}
+
+		s, err := parseSignal(strings.Fields(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("script line %d: %v", n, err)
+		}
+		signals[normalizeName(kv[0])] = s
+	}
+
+	return signals, scanner.Err()
+}
+
+func parseSignal(f []string) (*Signal, error) {
+	if len(f) == 0 {
+		return nil, fmt.Errorf("missing signal kind")
+	}
+
+	if f[0] == "str" {
+		return &Signal{Text: strings.Join(f[1:], " ")}, nil
+	}
+
+	args := make([]float64, 0, len(f)-1)
+	for _, a := range f[1:] {
+		v, err := parseArg(a)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	arg := func(i int, def float64) float64 {
+		if i < len(args) {
+			return args[i]
+		}
+		return def
+	}
+
+	need := map[string]int{"const": 1, "random": 2, "sine": 3, "daycurve": 1, "energy": 1, "total": 2, "bits": 2, "clock": 0}
+	n, ok := need[f[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal kind %q", f[0])
+	}
+	if len(args) < n {
+		return nil, fmt.Errorf("%s needs %d arguments", f[0], n)
+	}
+
+	var value func(t time.Time) float64
+	switch f[0] {
+	case "const":
+		value = func(t time.Time) float64 { return args[0] }
+	case "random":
+		value = func(t time.Time) float64 { return args[0] + rand.Float64()*(args[1]-args[0]) }
+	case "sine":
+		min, max, period := args[0], args[1], args[2]
+		if period <= 0 {
+			return nil, fmt.Errorf("sine period must be positive")
+		}
+		value = func(t time.Time) float64 {
+			phase := math.Mod(float64(t.UnixNano())/1e9, period) / period
+			return min + (max-min)*(1+math.Sin(2*math.Pi*phase))/2
+		}
+	case "daycurve":
+		peak, rise, set := args[0], arg(1, 6), arg(2, 20)
+		value = func(t time.Time) float64 { return dayCurve(peak, rise, set, hourOfDay(t)) }
+	case "energy":
+		peak, rise, set := args[0], arg(1, 6), arg(2, 20)
+		value = func(t time.Time) float64 { return dayEnergy(peak, rise, set, hourOfDay(t)) }
+	case "total":
+		peak, base, rise, set := args[0], args[1], arg(2, 6), arg(3, 20)
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+		value = func(t time.Time) float64 {
+			days := math.Floor(t.Sub(start).Hours() / 24)
+			return base + days*dayEnergy(peak, rise, set, 24) + dayEnergy(peak, rise, set, hourOfDay(t))
+		}
+	case "bits":
+		mask, period := args[0], args[1]
+		if period <= 0 {
+			return nil, fmt.Errorf("bits period must be positive")
+		}
+		value = func(t time.Time) float64 {
+			if int64(float64(t.Unix())/period)%2 == 1 {
+				return mask
+			}
+			return 0
+		}
+	case "clock":
+		value = func(t time.Time) float64 { return float64(t.Unix()) }
+	}
+
+	return &Signal{value: value}, nil
+}
+
+// parseArg accepts plain numbers, hex masks and durations (as seconds).
+func parseArg(a string) (float64, error) {
+	if strings.HasPrefix(a, "0x") || strings.HasPrefix(a, "0X") {
+		v, err := strconv.ParseUint(a[2:], 16, 32)
+		return float64(v), err
+	}
+	if v, err := strconv.ParseFloat(a, 64); err == nil {
+		return v, nil
+	}
+	d, err := time.ParseDuration(a)
+	if err != nil {
+		return 0, fmt.Errorf("invalid argument %q", a)
+	}
+	return d.Seconds(), nil
+}
+
+func hourOfDay(t time.Time) float64 {
+	return float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+}
+
+func dayCurve(peak, rise, set, h float64) float64 {
+	if h <= rise || h >= set {
+		return 0
+	}
+	s := math.Sin(math.Pi * (h - rise) / (set - rise))
+	return peak * s * s
+}
+
+// dayEnergy integrates dayCurve from midnight to hour h.
+func dayEnergy(peak, rise, set, h float64) float64 {
+	l := set - rise
+	x := math.Max(0, math.Min(h, set)-rise)
+	return peak * (x/2 - l*math.Sin(2*math.Pi*x/l)/(4*math.Pi))
+}
+
+// DefaultScript drives the registers of configs/ktl33.json and of the
+// bundled rfiles like a 30kW plant on a sunny day.
+const DefaultScript = `
+# configs/ktl33.json
+ESN = str SIM0000000001
+Rated inverter power = const 33000
+System Time = clock
+PV1 Voltage = daycurve 650 6 20
+PV1 Current = daycurve 9
+PV2 Voltage = daycurve 650
+PV2 Current = daycurve 9
+PV3 Voltage = daycurve 640
+PV3 Current = daycurve 8.5
+PV4 Voltage = daycurve 640
+PV4 Current = daycurve 8.5
+Uab = random 398 402
+Ubc = random 398 402
+Uca = random 398 402
+Ua = random 229 231
+Ub = random 229 231
+Uc = random 229 231
+Ia = daycurve 43
+Ib = daycurve 43
+Ic = daycurve 43
+Frequency = random 49.98 50.02
+Power factor = const 1
+Inverter efficiency = const 98.6
+Cabinet temperature = sine 25 45 24h
+Inverter status = const 512
+Active power peak of currentday = const 30
+Active power = daycurve 30
+Reactive power = random -0.2 0.2
+Total input power = daycurve 30.5
+Current electricity yield collection time = clock
+E-Day = energy 30
+E-Total = total 30 40000
+Inverter on-grid = const 1
+Insulation resistance = const 3.2
+MPPT1 total input power = daycurve 7.7
+MPPT2 total input power = daycurve 7.7
+MPPT3 total input power = daycurve 7.6
+MPPT4 total input power = daycurve 7.5
+alarm50000 = bits 0x1000 10m
+
+# rfile names
+active_power = daycurve 30
+input_power = daycurve 30.5
+peak_power = const 30
+eday = energy 30
+etotal = total 30 40000
+temp = sine 25 45 24h
+efficiency = const 98.6
+freq = random 49.98 50.02
+ctimets = clock
+Upv1 = daycurve 650
+Ipv1 = daycurve 9
+Upv2 = daycurve 650
+Ipv2 = daycurve 9
+status = const 512
+`
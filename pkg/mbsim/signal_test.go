@@ -0,0 +1,61 @@
+package mbsim
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSignal(t *testing.T) {
+	at := time.Date(2024, time.June, 1, 13, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		line string
+		err  bool
+	}{
+		{line: "const 42"},
+		{line: "random 1 2"},
+		{line: "sine 25 45 24h"},
+		{line: "daycurve 9"},
+		{line: "energy 30 6 20"},
+		{line: "total 30 1000"},
+		{line: "bits 0x0004 10m"},
+		{line: "clock"},
+		{line: "str SIM01"},
+		{line: "sine 25 45 0", err: true},
+		{line: "sine 25 45 -1h", err: true},
+		{line: "bits 0x0004 0", err: true},
+		{line: "bits 0x0004 -10m", err: true},
+		{line: "sine 25 45", err: true},
+		{line: "square 1", err: true},
+		{line: "const x", err: true},
+		{line: "", err: true},
+	}
+
+	for _, tt := range tests {
+		s, err := parseSignal(strings.Fields(tt.line))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: got no error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if v := s.Value(at); math.IsNaN(v) || math.IsInf(v, 0) {
+			t.Errorf("%q: got %v", tt.line, v)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	if _, err := ParseScript(strings.NewReader(DefaultScript)); err != nil {
+		t.Errorf("DefaultScript: %v", err)
+	}
+	if _, err := ParseScript(strings.NewReader("temp = sine 25 45 0s\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("zero period: got %v, want the line refused", err)
+	}
+}
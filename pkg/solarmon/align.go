@@ -0,0 +1,198 @@
+package solarmon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alignment turns the time of a reading into the timestamp of its point,
+// see ParseAlignment.
+type Alignment struct {
+	// None drops the point, Epoch writes it at 1970-01-01 so a single
+	// point is kept forever.
+	None  bool
+	Epoch bool
+
+	// Buckets of N units, Every for clock units, Period for calendar
+	// units. Back selects the bucket before the one holding the reading.
+	N      int
+	Every  time.Duration
+	Period Period
+	Back   bool
+	// UTC takes the buckets on the UTC calendar instead of the site one,
+	// as every bucket was before -tz.
+	UTC bool
+
+	// Register takes the time from another register holding UNIX seconds,
+	// or the site wall clock seconds when Local is set.
+	Register string
+	Local    bool
+
+	Offset time.Duration
+}
+
+// ParseAlignment parses the rfile timestamp field:
+//
+//	now, none, inf
+//	[-]N<unit>[/utc][(+|-)offset]  start of the current (or with '-' the
+//	                               previous) bucket of N units: s, min, h,
+//	                               d, w, mo, y. 'm' is months for N=1 and
+//	                               minutes otherwise, so 1m, 5m and 15m keep
+//	                               their old meaning
+//	@register[/local][(+|-)offset]
+//
+// Offsets use Go duration syntax, e.g. 1d+5h or -1d+5h. 1d/utc+5h is the
+// 05:00 UTC stamp 1d had before buckets followed the site calendar.
+func ParseAlignment(s string) (*Alignment, error) {
+	a := &Alignment{}
+	switch s {
+	case "", "now":
+		return a, nil
+	case "none":
+		a.None = true
+		return a, nil
+	case "inf":
+		a.Epoch = true
+		return a, nil
+	}
+
+	spec, offset := s, ""
+	if i := strings.IndexAny(s[1:], "+-"); i >= 0 {
+		spec, offset = s[:i+1], s[i+1:]
+	}
+
+	if offset != "" {
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q: %v", s, err)
+		}
+		a.Offset = d
+	}
+
+	if strings.HasPrefix(spec, "@") {
+		a.Register = strings.TrimPrefix(spec, "@")
+		if strings.HasSuffix(a.Register, "/local") {
+			a.Register, a.Local = strings.TrimSuffix(a.Register, "/local"), true
+		}
+		if a.Register == "" {
+			return nil, fmt.Errorf("invalid timestamp %q: register name missing", s)
+		}
+		return a, nil
+	}
+
+	if strings.HasPrefix(spec, "-") {
+		a.Back, spec = true, spec[1:]
+	}
+	if strings.HasSuffix(spec, "/utc") {
+		a.UTC, spec = true, strings.TrimSuffix(spec, "/utc")
+	}
+
+	i := strings.IndexFunc(spec, func(r rune) bool { return r < '0' || r > '9' })
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	n, err := strconv.Atoi(spec[:i])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid timestamp %q", s)
+	}
+	a.N = n
+
+	switch unit := spec[i:]; {
+	case unit == "s":
+		a.Every = time.Duration(n) * time.Second
+	case unit == "min" || unit == "m" && n != 1:
+		a.Every = time.Duration(n) * time.Minute
+	case unit == "h":
+		a.Every = time.Duration(n) * time.Hour
+	case unit == "m" || unit == "mo":
+		a.Period = PeriodMonth
+	default:
+		p, err := ParsePeriod(unit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q: %v", s, err)
+		}
+		a.Period = p
+	}
+
+	if a.Every > 24*time.Hour {
+		return nil, fmt.Errorf("invalid timestamp %q: use d or w for buckets longer than a day", s)
+	}
+	return a, nil
+}
+
+// Time returns the point timestamp for a reading taken at now. value
+// looks up other registers for @register alignments. ok is false when
+// the point should not be written.
+func (a *Alignment) Time(now time.Time, loc *time.Location, value func(name string) (float64, bool)) (time.Time, bool) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	switch {
+	case a.None:
+		return time.Time{}, false
+	case a.Epoch:
+		return time.Unix(0, 0), true
+	case a.Register != "":
+		v, ok := value(a.Register)
+		if !ok || v <= 0 {
+			return time.Time{}, false
+		}
+		ts := time.Unix(int64(v), 0)
+		if a.Local {
+			// wall clock seconds, re-read the UTC fields as site time
+			u := ts.UTC()
+			ts = time.Date(u.Year(), u.Month(), u.Day(), u.Hour(), u.Minute(), u.Second(), 0, loc)
+		}
+		return ts.Add(a.Offset), true
+	case a.N == 0:
+		return now, true
+	case a.UTC:
+		loc = time.UTC
+	}
+
+	start := a.bucket(now, loc)
+	if a.Back {
+		start = a.bucket(start.Add(-time.Nanosecond), loc)
+	}
+	return start.Add(a.Offset), true
+}
+
+// bucket returns the start of the bucket holding t. Clock buckets count
+// from local midnight, calendar buckets of more than one unit from the
+// UNIX epoch on the local calendar.
+func (a *Alignment) bucket(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+
+	if a.Every > 0 {
+		day := PeriodDay.Start(t, loc)
+		return day.Add(t.Sub(day) / a.Every * a.Every)
+	}
+
+	start := a.Period.Start(t, loc)
+	if a.N == 1 {
+		return start
+	}
+
+	switch a.Period {
+	case PeriodDay, PeriodWeek:
+		epoch := a.Period.Start(time.Date(1970, time.January, 5, 0, 0, 0, 0, loc), loc)
+		days := int(start.Sub(epoch).Hours()/24 + 0.5)
+		per := a.N
+		if a.Period == PeriodWeek {
+			per *= 7
+		}
+		days -= (days%per + per) % per
+		return time.Date(epoch.Year(), epoch.Month(), epoch.Day()+days, 0, 0, 0, 0, loc)
+	case PeriodMonth:
+		months := start.Year()*12 + int(start.Month()) - 1
+		months -= months % a.N
+		return time.Date(months/12, time.Month(months%12+1), 1, 0, 0, 0, 0, loc)
+	case PeriodYear:
+		return time.Date(start.Year()-start.Year()%a.N, time.January, 1, 0, 0, 0, 0, loc)
+	}
+	return start
+}
@@ -0,0 +1,102 @@
+package solarmon
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func site(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseAlignment(t *testing.T) {
+	loc := site(t)
+	at := func(y int, mo time.Month, d, h, min int, loc *time.Location) time.Time {
+		return time.Date(y, mo, d, h, min, 0, 0, loc)
+	}
+	noon := at(2024, time.June, 15, 13, 47, loc)
+	// wall clock seconds of 12:00 at the site, and the UTC instant
+	clock := float64(at(2024, time.June, 15, 12, 0, time.UTC).Unix())
+
+	tests := []struct {
+		spec string
+		now  time.Time
+		want time.Time
+	}{
+		{spec: "1h", now: noon, want: at(2024, time.June, 15, 13, 0, loc)},
+		{spec: "-1h", now: noon, want: at(2024, time.June, 15, 12, 0, loc)},
+		{spec: "15m", now: noon, want: at(2024, time.June, 15, 13, 45, loc)},
+		{spec: "5m", now: noon, want: at(2024, time.June, 15, 13, 45, loc)},
+		{spec: "1m", now: noon, want: at(2024, time.June, 1, 0, 0, loc)},
+		{spec: "1mo", now: noon, want: at(2024, time.June, 1, 0, 0, loc)},
+		{spec: "1d+5h", now: noon, want: at(2024, time.June, 15, 5, 0, loc)},
+		{spec: "-1d+5h", now: noon, want: at(2024, time.June, 14, 5, 0, loc)},
+		{spec: "1y", now: noon, want: at(2024, time.January, 1, 0, 0, loc)},
+		{spec: "1w", now: noon, want: at(2024, time.June, 10, 0, 0, loc)},
+		// the old 05:00 UTC stamps, 00:30 at the site is still the previous UTC day
+		{spec: "1d/utc+5h", now: at(2024, time.June, 15, 0, 30, loc), want: at(2024, time.June, 14, 5, 0, time.UTC)},
+		{spec: "-1m/utc+5h", now: noon, want: at(2024, time.May, 1, 5, 0, time.UTC)},
+		{spec: "1y/utc+5h", now: noon, want: at(2024, time.January, 1, 5, 0, time.UTC)},
+		{spec: "@clock", now: noon, want: at(2024, time.June, 15, 12, 0, time.UTC)},
+		{spec: "@clock/local", now: noon, want: at(2024, time.June, 15, 12, 0, loc)},
+		{spec: "@clock/local-1h", now: noon, want: at(2024, time.June, 15, 11, 0, loc)},
+		// an hour is missing on the 31st of March and repeated on the 27th of October
+		{spec: "1h", now: at(2024, time.March, 31, 3, 30, loc), want: at(2024, time.March, 31, 3, 0, loc)},
+		{spec: "1d", now: at(2024, time.March, 31, 23, 30, loc), want: at(2024, time.March, 31, 0, 0, loc)},
+		{spec: "1h", now: at(2024, time.October, 27, 1, 30, time.UTC), want: at(2024, time.October, 27, 1, 0, time.UTC)},
+	}
+
+	value := func(name string) (float64, bool) { return clock, name == "clock" }
+	for _, tt := range tests {
+		a, err := ParseAlignment(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		got, ok := a.Time(tt.now, loc, value)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("%s at %s: got %s %v, want %s", tt.spec, tt.now, got, ok, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"25h", "48h", "1500min", "1x", "0d", "d", "@", "1d+x"} {
+		if _, err := ParseAlignment(spec); err == nil {
+			t.Errorf("%s: got no error", spec)
+		}
+	}
+}
+
+func TestPeriodDST(t *testing.T) {
+	loc := site(t)
+
+	tests := []struct {
+		period Period
+		at     time.Time
+		start  time.Time
+		length time.Duration
+	}{
+		{PeriodDay, time.Date(2024, time.March, 31, 12, 0, 0, 0, loc), time.Date(2024, time.March, 31, 0, 0, 0, 0, loc), 23 * time.Hour},
+		{PeriodDay, time.Date(2024, time.October, 27, 12, 0, 0, 0, loc), time.Date(2024, time.October, 27, 0, 0, 0, 0, loc), 25 * time.Hour},
+		{PeriodWeek, time.Date(2024, time.October, 27, 12, 0, 0, 0, loc), time.Date(2024, time.October, 21, 0, 0, 0, 0, loc), 7*24*time.Hour + time.Hour},
+		{PeriodMonth, time.Date(2024, time.March, 31, 12, 0, 0, 0, loc), time.Date(2024, time.March, 1, 0, 0, 0, 0, loc), 31*24*time.Hour - time.Hour},
+		// 02:30 twice, first in summer time, then in winter time
+		{PeriodHour, time.Date(2024, time.October, 27, 0, 30, 0, 0, time.UTC), time.Date(2024, time.October, 27, 0, 0, 0, 0, time.UTC), time.Hour},
+		{PeriodHour, time.Date(2024, time.October, 27, 1, 30, 0, 0, time.UTC), time.Date(2024, time.October, 27, 1, 0, 0, 0, time.UTC), time.Hour},
+	}
+
+	for _, tt := range tests {
+		start := tt.period.Start(tt.at, loc)
+		if !start.Equal(tt.start) {
+			t.Errorf("%s start of %s: got %s, want %s", tt.period, tt.at, start, tt.start)
+		}
+		if next := tt.period.Next(start, loc); next.Sub(start) != tt.length {
+			t.Errorf("%s from %s: got next %s, %s later, want %s", tt.period, start, next, next.Sub(start), tt.length)
+		}
+	}
+}
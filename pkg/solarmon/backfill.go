@@ -0,0 +1,126 @@
+package solarmon
+
+import (
+	"fmt"
+	"time"
+)
+
+// backfillSpec pairs a previous period register (e.g. the yield of the
+// previous hour, 32345) with its collection time register (32343), set
+// with an rfile line
+//
+//	%backfill:register:time register:period
+type backfillSpec struct {
+	period Period
+	time   *Register
+}
+
+type backfillSeries struct {
+	value   *Register
+	spec    *backfillSpec
+	lastOK  time.Time
+	failed  bool
+	written time.Time
+}
+
+// Backfill writes the previous period registers stamped with the
+// collection time the inverter reports when they can be read again, after
+// start or failed reads, and tells which periods of the outage are lost:
+// the inverter only keeps the one before the current period.
+type Backfill struct {
+	loc    *time.Location
+	local  bool
+	series []*backfillSeries
+}
+
+// NewBackfill returns nil when no register has a %backfill line.
+func NewBackfill(registers []*Register, cfg *Config) *Backfill {
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	b := &Backfill{loc: loc, local: cfg.ClockLocal}
+	for _, r := range registers {
+		if r.backfill != nil {
+			b.series = append(b.series, &backfillSeries{value: r, spec: r.backfill})
+		}
+	}
+
+	if len(b.series) == 0 {
+		return nil
+	}
+	return b
+}
+
+// Update looks at the registers read in the cycle at now and returns the
+// previous period values to write, with notes about lost periods.
+func (b *Backfill) Update(now time.Time) ([]*Register, []string) {
+	var points []*Register
+	var notes []string
+
+	for _, s := range b.series {
+		v, ok := s.value.numeric()
+		ct, tsOK := s.spec.time.numeric()
+		if !ok || !tsOK {
+			s.failed = true
+			continue
+		}
+
+		resumed := s.lastOK.IsZero() || s.failed
+		since := s.lastOK
+		s.lastOK, s.failed = now, false
+		if !resumed || ct <= 0 {
+			continue
+		}
+
+		if lost := b.lost(s.spec.period, now, since); lost > 0 {
+			notes = append(notes, fmt.Sprintf(
+				"backfill %s: %d %s period(s) since %s lost, the inverter only keeps the previous one",
+				s.value.name, lost, s.spec.period, since.In(b.loc).Format("2006-01-02 15:04"),
+			))
+		}
+
+		ts := deviceTime(uint32(ct), b.local, b.loc)
+		if ts.Equal(s.written) {
+			continue
+		}
+		s.written = ts
+		points = append(points, s.point(v, ts, now))
+	}
+	return points, notes
+}
+
+// lost counts the periods whose final value was neither read live (the
+// one running at since) nor is the previous period available now.
+func (b *Backfill) lost(p Period, now, since time.Time) int {
+	if since.IsZero() {
+		return 0
+	}
+
+	previous := p.Start(p.Start(now, b.loc).Add(-time.Nanosecond), b.loc)
+	n := 0
+	for start := p.Start(since, b.loc); start.Before(previous); start = p.Next(start, b.loc) {
+		n++
+	}
+	return n
+}
+
+func (s *backfillSeries) point(v float64, ts, now time.Time) *Register {
+	s.value.Mutex.Lock()
+	defer s.value.Mutex.Unlock()
+
+	r := NewRegister()
+	r.id = s.value.id
+	r.name = s.value.name
+	r.unit = s.value.unit
+	r.gain = 1
+	r.vtype = "F64"
+	r.num, r.numOK = v, true
+	r.value = fmt.Sprint(v)
+	r.MName = s.value.MName
+	r.TsType = "period"
+	r.ts = ts
+	r.lastRead = now
+	return r
+}
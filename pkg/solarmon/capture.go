@@ -0,0 +1,272 @@
+package solarmon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// CaptureRecord is one bus transaction, written as a JSON line. PDUs are
+// hex encoded function code + data, Resp is empty when no answer came back.
+type CaptureRecord struct {
+	Ts    time.Time `json:"ts"`
+	Slave uint      `json:"slave"`
+	PDU   string    `json:"pdu"`
+	Resp  string    `json:"resp,omitempty"`
+	Err   string    `json:"err,omitempty"`
+	Class ErrClass  `json:"class,omitempty"`
+}
+
+// RecordingTransport passes reads through to another transport and
+// records every request and response to a capture file.
+type RecordingTransport struct {
+	Transport
+	slave uint
+	mutex *sync.Mutex
+	file  *os.File
+	enc   *json.Encoder
+}
+
+func NewRecordingTransport(t Transport, file string, slave uint) (*RecordingTransport, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecordingTransport{Transport: t, slave: slave, mutex: &sync.Mutex{}, file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (t *RecordingTransport) Read(id uint16, cnt uint16) ([]byte, error) {
+	r, err := t.Transport.Read(id, cnt)
+	t.record(readPDU(id, cnt), append([]byte{byte(len(r))}, r...), err)
+	return r, err
+}
+
+func (t *RecordingTransport) Close() {
+	t.Transport.Close()
+	t.file.Close()
+}
+
+// Write forwards to the wrapped transport and records the transaction.
+func (t *RecordingTransport) Write(id uint16, data []byte) error {
+	w, ok := t.Transport.(RegisterWriter)
+	if !ok {
+		return errors.New("the transport can not write registers")
+	}
+	err := w.Write(id, data)
+
+	pdu := writePDU(id, data)
+	t.record(pdu, pdu[1:5], err)
+	return err
+}
+
+// Upload forwards to the wrapped transport and records the transaction.
+func (t *RecordingTransport) Upload(req []byte) ([]byte, error) {
+	u, ok := t.Transport.(FileUploader)
+	if !ok {
+		return nil, errors.New("the transport can not upload files")
+	}
+	resp, err := u.Upload(req)
+	t.record(append([]byte{FuncCodeHuaweiExtended}, req...), resp, err)
+	return resp, err
+}
+
+// record writes the request pdu with the answer data following the
+// function code, an exception or the error.
+func (t *RecordingTransport) record(pdu []byte, data []byte, err error) {
+	rec := CaptureRecord{
+		Ts:    time.Now(),
+		Slave: t.slave,
+		PDU:   hex.EncodeToString(pdu),
+	}
+
+	var busErr *BusError
+	switch {
+	case err == nil:
+		rec.Resp = hex.EncodeToString(append([]byte{pdu[0]}, data...))
+	case errors.As(err, &busErr) && busErr.Class == ErrClassException:
+		rec.Resp = hex.EncodeToString([]byte{pdu[0] | 0x80, busErr.Code})
+		rec.Class = busErr.Class
+	default:
+		rec.Err = err.Error()
+		rec.Class = ClassifyError(err)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// Losing the capture must not stop the polling
+	t.enc.Encode(rec)
+}
+
+// Health forwards to the wrapped transport, so recording does not hide
+// the link state from the poller.
+func (t *RecordingTransport) Health() HealthStatus {
+	if reporter, ok := t.Transport.(HealthReporter); ok {
+		return reporter.Health()
+	}
+	return HealthStatus{State: HealthHealthy}
+}
+
+// FiniteTransport is implemented by transports with a limited supply of
+// answers, the poller stops once Exhausted reports true.
+type FiniteTransport interface {
+	Exhausted() bool
+}
+
+// TimeSource is implemented by transports answering from a recording, Now
+// is the recorded time of the last answer. The poller and the outputs then
+// run on the recorded clock, so a replay stamps, aligns and splits the
+// readings like the site did.
+type TimeSource interface {
+	Now() time.Time
+}
+
+// transportNow is the time of the answer t just gave: the recorded one for
+// replays, the host clock otherwise.
+func transportNow(t Transport) time.Time {
+	if ts, ok := t.(TimeSource); ok {
+		if now := ts.Now(); !now.IsZero() {
+			return now
+		}
+	}
+	return time.Now()
+}
+
+// ReplayTransport answers reads from a capture file. Every request is
+// answered with its recorded responses in order, so a poll loop over the
+// same registers sees exactly what the site saw, at the recorded times.
+type ReplayTransport struct {
+	mutex   *sync.Mutex
+	answers map[string][]CaptureRecord
+	asked   map[string]bool
+	last    time.Time
+}
+
+func NewReplayTransport(file string) (*ReplayTransport, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &ReplayTransport{mutex: &sync.Mutex{}, answers: make(map[string][]CaptureRecord), asked: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		t.answers[rec.PDU] = append(t.answers[rec.PDU], rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(t.answers) == 0 {
+		return nil, fmt.Errorf("%s: no records", file)
+	}
+	return t, nil
+}
+
+func (t *ReplayTransport) Read(id uint16, cnt uint16) ([]byte, error) {
+	resp, err := t.answer(readPDU(id, cnt), OpRead, id)
+	if err != nil {
+		return nil, err
+	}
+	return resp[1:], nil
+}
+
+// Write answers register writes recorded by RecordingTransport, the data
+// must match the recorded request.
+func (t *ReplayTransport) Write(id uint16, data []byte) error {
+	_, err := t.answer(writePDU(id, data), OpWrite, id)
+	return err
+}
+
+// Upload answers file upload requests recorded by RecordingTransport.
+func (t *ReplayTransport) Upload(req []byte) ([]byte, error) {
+	return t.answer(append([]byte{FuncCodeHuaweiExtended}, req...), OpUpload, 0)
+}
+
+// answer returns the next recorded response to pdu without its function
+// code.
+func (t *ReplayTransport) answer(pdu []byte, op BusOp, id uint16) ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := hex.EncodeToString(pdu)
+	t.asked[key] = true
+	records := t.answers[key]
+	if len(records) == 0 {
+		return nil, &BusError{Class: ErrClassTransport, Op: op, Addr: id, Err: errors.New("no more answers in capture")}
+	}
+	rec := records[0]
+	t.answers[key] = records[1:]
+	t.last = rec.Ts
+
+	if rec.Resp == "" {
+		return nil, &BusError{Class: rec.Class, Op: op, Addr: id, Err: errors.New(rec.Err)}
+	}
+
+	resp, err := hex.DecodeString(rec.Resp)
+	if err != nil || len(resp) < 2 {
+		return nil, &BusError{Class: ErrClassFraming, Op: op, Addr: id, Err: fmt.Errorf("bad capture response %q", rec.Resp)}
+	}
+
+	if resp[0]&0x80 != 0 {
+		mbErr := &modbus.ModbusError{FunctionCode: resp[0], ExceptionCode: resp[1]}
+		return nil, &BusError{Class: ErrClassException, Op: op, Code: resp[1], Addr: id, Err: mbErr}
+	}
+
+	return resp[1:], nil
+}
+
+// Exhausted reports whether the requests seen so far have no recorded
+// answers left. Requests never made do not keep the replay going.
+func (t *ReplayTransport) Exhausted() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key := range t.asked {
+		if len(t.answers[key]) > 0 {
+			return false
+		}
+	}
+	return len(t.asked) > 0
+}
+
+// Now is the recorded time of the last answer.
+func (t *ReplayTransport) Now() time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.last
+}
+
+func (t *ReplayTransport) Close() {}
+
+func readPDU(id uint16, cnt uint16) []byte {
+	pdu := []byte{modbus.FuncCodeReadHoldingRegisters, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], id)
+	binary.BigEndian.PutUint16(pdu[3:], cnt)
+	return pdu
+}
+
+func writePDU(id uint16, data []byte) []byte {
+	pdu := []byte{modbus.FuncCodeWriteMultipleRegisters, 0, 0, 0, 0, byte(len(data))}
+	binary.BigEndian.PutUint16(pdu[1:], id)
+	binary.BigEndian.PutUint16(pdu[3:], uint16(len(data)/2))
+	return append(pdu, data...)
+}
@@ -0,0 +1,68 @@
+package solarmon
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	sim := startSimulator(t)
+	file := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	live, err := NewTransport(simConfig(t, "-tcp", sim.tcp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := NewRecordingTransport(live, file, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	read, err := rec.Read(32290, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := []byte{0x12, 0x34, 0x56, 0x78}
+	// not in the simulator map, answered with an exception
+	rec.Write(40000, clock)
+	if err := rec.Write(32290, read); err != nil {
+		t.Fatal(err)
+	}
+	rec.Close()
+	after := time.Now()
+
+	replay, err := NewReplayTransport(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replay.Now().IsZero() {
+		t.Errorf("Now before any answer: got %s, want zero", replay.Now())
+	}
+
+	got, err := replay.Read(32290, 2)
+	if err != nil || !bytes.Equal(got, read) {
+		t.Errorf("read: got % x %v, want % x", got, err, read)
+	}
+	if at := replay.Now(); at.Before(before) || at.After(after) {
+		t.Errorf("Now: got %s, want the recorded time between %s and %s", at, before, after)
+	}
+	if at := transportNow(replay); !at.Equal(replay.Now()) {
+		t.Errorf("transportNow: got %s, want the recorded %s", at, replay.Now())
+	}
+
+	if err := replay.Write(40000, clock); err == nil {
+		t.Error("clock write: got no error, want the recorded exception")
+	}
+	if err := replay.Write(32290, read); err != nil {
+		t.Errorf("write: %v", err)
+	}
+	if err := replay.Write(32290, []byte{0, 0, 0, 1}); err == nil {
+		t.Error("write of other data: got no error, want no recorded answer")
+	}
+	if !replay.Exhausted() {
+		t.Error("replay not exhausted after every recorded request")
+	}
+}
@@ -0,0 +1,181 @@
+package solarmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RegisterWriter is implemented by transports able to write holding
+// registers (function 16).
+type RegisterWriter interface {
+	Write(id uint16, data []byte) error
+}
+
+// minSaneTime is earlier than any clock this build can meet in the field,
+// a host clock before it was never set.
+var minSaneTime = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// minClockSetInterval limits how often a clock is set.
+const minClockSetInterval = time.Hour
+
+// Clock compares the host clock with the inverter clock every cycle. It
+// reports the drift, optionally sets one clock from the other and tells
+// the poller whether host timestamps can be trusted yet.
+type Clock struct {
+	register uint16
+	local    bool
+	sync     string
+	maxDrift time.Duration
+	window   time.Duration
+	loc      *time.Location
+
+	synced  bool
+	lastSet time.Time
+}
+
+// NewClock returns nil when -clockReg is 0.
+func NewClock(cfg *Config) (*Clock, error) {
+	if cfg.ClockRegister == 0 {
+		return nil, nil
+	}
+
+	switch cfg.ClockSync {
+	case "", "inverter", "host":
+	default:
+		return nil, fmt.Errorf("invalid -clockSync %q, want inverter or host", cfg.ClockSync)
+	}
+
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	return &Clock{
+		register: uint16(cfg.ClockRegister),
+		local:    cfg.ClockLocal,
+		sync:     cfg.ClockSync,
+		maxDrift: cfg.ClockMaxDrift,
+		window:   cfg.ClockWindow,
+		loc:      loc,
+	}, nil
+}
+
+// Synced reports whether the host clock was found trustworthy: the kernel
+// says it is synchronised, it agrees with the inverter, it was set from
+// the inverter, or it is the reference for the inverter.
+func (c *Clock) Synced() bool {
+	return c.synced
+}
+
+// Check reads the inverter clock and returns the drift (inverter minus
+// host) as a register for the outputs, plus a note when a clock was set.
+// A clock that could not be set is an error returned with the drift.
+func (c *Clock) Check(t Transport) (*Register, string, error) {
+	// the kernel verdict holds without the inverter, a failed read must
+	// not keep -clockHold on
+	kernelSynced, known := hostClockSynced()
+
+	raw, err := t.Read(c.register, 2)
+	host := transportNow(t)
+	if err == nil && len(raw) != 4 {
+		err = fmt.Errorf("clock register %d: unexpected length %d", c.register, len(raw))
+	}
+	if err != nil {
+		c.synced = c.synced || (known && kernelSynced)
+		return nil, "", err
+	}
+
+	inverter := c.decode(binary.BigEndian.Uint32(raw))
+	drift := inverter.Sub(host).Round(time.Second)
+
+	hostSane := !host.Before(minSaneTime)
+	inverterSane := !inverter.Before(minSaneTime)
+	c.synced = (known && kernelSynced) ||
+		(hostSane && abs(drift) <= c.maxDrift) ||
+		(hostSane && c.sync == "inverter")
+
+	// a replay runs on the recorded clock, it never sets the host one
+	_, replay := t.(TimeSource)
+
+	var note string
+	var setErr error
+	if abs(drift) > c.maxDrift && host.Sub(c.lastSet) >= minClockSetInterval {
+		switch {
+		case c.sync == "inverter" && hostSane && ((known && kernelSynced) || abs(drift) <= c.window):
+			c.lastSet = host
+			if err := c.setInverter(t, host); err != nil {
+				setErr = fmt.Errorf("unable to set the inverter clock: %v", err)
+			} else {
+				note = fmt.Sprintf("inverter clock set from host, drift was %s", drift)
+			}
+
+		case c.sync == "host" && !replay && inverterSane && !(known && kernelSynced) && (!hostSane || abs(drift) <= c.window):
+			c.lastSet = host
+			if err := setHostClock(time.Now().Add(drift)); err != nil {
+				setErr = fmt.Errorf("unable to set the host clock: %v", err)
+			} else {
+				c.synced = true
+				c.lastSet = time.Now()
+				note = fmt.Sprintf("host clock set from inverter, drift was %s", drift)
+			}
+		}
+	}
+
+	r := NewRegister()
+	r.id = uint64(c.register)
+	r.name = "clock_drift"
+	r.unit = "s"
+	r.gain = 1
+	r.vtype = "F64"
+	r.num, r.numOK = drift.Seconds(), true
+	r.value = fmt.Sprint(r.num)
+	r.TsType = "now"
+	r.MName = "clock"
+	r.lastRead = host
+	return r, note, setErr
+}
+
+// decode turns the register value into a time. SUN2000 inverters keep
+// the site wall clock in it, not UTC seconds.
+func (c *Clock) decode(v uint32) time.Time {
+	return deviceTime(v, c.local, c.loc)
+}
+
+func (c *Clock) encode(t time.Time) uint32 {
+	if !c.local {
+		return uint32(t.Unix())
+	}
+	l := t.In(c.loc)
+	return uint32(time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), 0, time.UTC).Unix())
+}
+
+func (c *Clock) setInverter(t Transport, now time.Time) error {
+	w, ok := t.(RegisterWriter)
+	if !ok {
+		return errors.New("the transport can not write registers")
+	}
+
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, c.encode(now))
+	return w.Write(c.register, data)
+}
+
+// deviceTime turns device seconds into a time, local seconds count the
+// wall clock of loc as if it was UTC.
+func deviceTime(v uint32, local bool, loc *time.Location) time.Time {
+	t := time.Unix(int64(v), 0)
+	if !local {
+		return t
+	}
+	u := t.UTC()
+	return time.Date(u.Year(), u.Month(), u.Day(), u.Hour(), u.Minute(), u.Second(), 0, loc)
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package solarmon
+
+import (
+	"syscall"
+	"time"
+)
+
+// staUnsync is STA_UNSYNC from timex.h
+const staUnsync = 0x0040
+
+// hostClockSynced asks the kernel whether NTP (or anything using
+// adjtimex) keeps the clock synchronised.
+func hostClockSynced() (synced bool, known bool) {
+	var tx syscall.Timex
+	if _, err := syscall.Adjtimex(&tx); err != nil {
+		return false, false
+	}
+	return tx.Status&staUnsync == 0, true
+}
+
+func setHostClock(t time.Time) error {
+	tv := syscall.NsecToTimeval(t.UnixNano())
+	return syscall.Settimeofday(&tv)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package solarmon
+
+import (
+	"errors"
+	"time"
+)
+
+func hostClockSynced() (synced bool, known bool) {
+	return false, false
+}
+
+func setHostClock(t time.Time) error {
+	return errors.New("setting the host clock is only supported on linux")
+}
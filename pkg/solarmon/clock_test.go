@@ -0,0 +1,65 @@
+package solarmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// clockTransport answers reads of the clock register with the host time
+// plus ahead, or with err, and rejects every write.
+type clockTransport struct {
+	ahead time.Duration
+	err   error
+}
+
+func (t *clockTransport) Read(id uint16, cnt uint16) ([]byte, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(time.Now().Add(t.ahead).Unix()))
+	return data, nil
+}
+
+func (t *clockTransport) Write(id uint16, data []byte) error {
+	return NewBusError(OpWrite, id, errors.New("illegal address"))
+}
+
+func (t *clockTransport) Close() {}
+
+func TestClockReadFailure(t *testing.T) {
+	c, err := NewClock(&Config{ClockRegister: 40000, ClockMaxDrift: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drift, _, err := c.Check(&clockTransport{err: errors.New("timeout")})
+	if err == nil || drift != nil {
+		t.Fatalf("got %v %v, want the read error alone", drift, err)
+	}
+	if synced, known := hostClockSynced(); c.Synced() != (known && synced) {
+		t.Errorf("Synced: got %v, want the kernel verdict %v", c.Synced(), known && synced)
+	}
+}
+
+func TestClockSetFailure(t *testing.T) {
+	c, err := NewClock(&Config{
+		ClockRegister: 40000,
+		ClockSync:     "inverter",
+		ClockMaxDrift: 5 * time.Second,
+		ClockWindow:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drift, note, err := c.Check(&clockTransport{ahead: 10 * time.Minute})
+	if err == nil || note != "" {
+		t.Errorf("got note %q and %v, want the failed write as an error", note, err)
+	}
+	if drift == nil || drift.num < 599 || drift.num > 601 {
+		t.Errorf("drift: got %+v, want 600s", drift)
+	}
+}
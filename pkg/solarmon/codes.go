@@ -0,0 +1,219 @@
+package solarmon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CodeTable turns the raw value of a state register into a label. Enum
+// tables map whole values, bitmask tables name the single bits and the
+// label lists the bits that are set.
+type CodeTable struct {
+	Name    string
+	Bitmask bool
+	Labels  map[uint64]string
+}
+
+// Label decodes v, unknown values and bits are shown in hex.
+func (t *CodeTable) Label(v uint64) string {
+	if !t.Bitmask {
+		if l, ok := t.Labels[v]; ok {
+			return l
+		}
+		return fmt.Sprintf("unknown 0x%04X", v)
+	}
+
+	var flags []string
+	for bit := uint64(0); bit < 64; bit++ {
+		if v&(1<<bit) == 0 {
+			continue
+		}
+		if l, ok := t.Labels[bit]; ok {
+			flags = append(flags, l)
+		} else {
+			flags = append(flags, fmt.Sprintf("bit%d", bit))
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// ParseCodeTable parses an rfile table line:
+//
+//	%enum:name:value=label,value=label...
+//	%bits:name:bit=flag,bit=flag...
+//
+// Values may be decimal or 0x prefixed hex, labels must not contain ','.
+func ParseCodeTable(line string) (*CodeTable, error) {
+	parts := strings.SplitN(strings.TrimPrefix(line, "%"), ":", 3)
+	if len(parts) != 3 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid code table %q", line)
+	}
+
+	t := &CodeTable{Name: parts[1], Labels: make(map[uint64]string)}
+	switch parts[0] {
+	case "enum":
+	case "bits":
+		t.Bitmask = true
+	default:
+		return nil, fmt.Errorf("invalid code table %q: unknown kind %s", line, parts[0])
+	}
+
+	for _, entry := range strings.Split(parts[2], ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("code table %s: invalid entry %q", t.Name, entry)
+		}
+		k, err := strconv.ParseUint(strings.TrimSpace(kv[0]), 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("code table %s: invalid entry %q", t.Name, entry)
+		}
+		if t.Bitmask && k > 63 {
+			return nil, fmt.Errorf("code table %s: bit %d out of range", t.Name, k)
+		}
+		t.Labels[k] = strings.TrimSpace(kv[1])
+	}
+	return t, nil
+}
+
+// BuiltinCodeTables are always available to %decode lines, they follow the
+// SUN2000 MODBUS Interface Definitions and the SunSpec inverter models.
+var BuiltinCodeTables = map[string]*CodeTable{
+	// 32089 device status on the M series, 32287 on KTL-A
+	"sun2000_status": {Name: "sun2000_status", Labels: map[uint64]string{
+		0x0000: "Standby: initializing",
+		0x0001: "Standby: detecting insulation resistance",
+		0x0002: "Standby: detecting irradiation",
+		0x0003: "Standby: grid detecting",
+		0x0100: "Starting",
+		0x0200: "On-grid",
+		0x0201: "Grid connection: power limited",
+		0x0202: "Grid connection: self-derating",
+		0x0203: "Off-grid running",
+		0x0300: "Shutdown: fault",
+		0x0301: "Shutdown: command",
+		0x0302: "Shutdown: OVGR",
+		0x0303: "Shutdown: communication disconnected",
+		0x0304: "Shutdown: power limited",
+		0x0305: "Shutdown: manual startup required",
+		0x0306: "Shutdown: DC switches disconnected",
+		0x0307: "Shutdown: rapid cutoff",
+		0x0308: "Shutdown: input underpower",
+		0x0401: "Grid scheduling: cosphi-P curve",
+		0x0402: "Grid scheduling: Q-U curve",
+		0x0403: "Grid scheduling: PF-U curve",
+		0x0404: "Grid scheduling: dry contact",
+		0x0405: "Grid scheduling: Q-P curve",
+		0x0500: "Spot-check ready",
+		0x0501: "Spot-checking",
+		0x0600: "Inspecting",
+		0x0700: "AFCI self check",
+		0x0800: "I-V scanning",
+		0x0900: "DC input detection",
+		0x0A00: "Running: off-grid charging",
+		0xA000: "Standby: no irradiation",
+	}},
+	// 32000
+	"sun2000_state1": {Name: "sun2000_state1", Bitmask: true, Labels: map[uint64]string{
+		0: "Standby",
+		1: "Grid-connected",
+		2: "Grid-connected normally",
+		3: "Derating due to power rationing",
+		4: "Derating due to internal causes",
+		5: "Normal stop",
+		6: "Stop due to faults",
+		7: "Stop due to power rationing",
+		8: "Shutdown",
+		9: "Spot check",
+	}},
+	// 32002
+	"sun2000_state2": {Name: "sun2000_state2", Bitmask: true, Labels: map[uint64]string{
+		0: "Unlocked",
+		1: "PV connected",
+		2: "DSP data collection",
+	}},
+	// 32003
+	"sun2000_state3": {Name: "sun2000_state3", Bitmask: true, Labels: map[uint64]string{
+		0: "Off-grid",
+		1: "Off-grid switch enabled",
+	}},
+	// 32008
+	"sun2000_alarm1": {Name: "sun2000_alarm1", Bitmask: true, Labels: map[uint64]string{
+		0:  "High string input voltage",
+		1:  "DC arc fault",
+		2:  "String reverse connection",
+		3:  "String current backfeed",
+		4:  "Abnormal string power",
+		5:  "AFCI self-check fail",
+		6:  "Phase wire short-circuited to PE",
+		7:  "Grid loss",
+		8:  "Grid undervoltage",
+		9:  "Grid overvoltage",
+		10: "Grid voltage imbalance",
+		11: "Grid overfrequency",
+		12: "Grid underfrequency",
+		13: "Unstable grid frequency",
+		14: "Output overcurrent",
+		15: "Output DC component overhigh",
+	}},
+	// 32009
+	"sun2000_alarm2": {Name: "sun2000_alarm2", Bitmask: true, Labels: map[uint64]string{
+		0:  "Abnormal residual current",
+		1:  "Abnormal grounding",
+		2:  "Low insulation resistance",
+		3:  "Overtemperature",
+		4:  "Device fault",
+		5:  "Upgrade failed or version mismatch",
+		6:  "License expired",
+		7:  "Faulty monitoring unit",
+		8:  "Faulty power collector",
+		9:  "Battery abnormal",
+		10: "Active islanding",
+		11: "Passive islanding",
+		12: "Transient AC overvoltage",
+		13: "Peripheral port short circuit",
+		14: "Churn output overload",
+		15: "Abnormal PV module configuration",
+	}},
+	// 32010
+	"sun2000_alarm3": {Name: "sun2000_alarm3", Bitmask: true, Labels: map[uint64]string{
+		0: "Optimizer fault",
+		1: "Built-in PID operation abnormal",
+		2: "High input string voltage to ground",
+		3: "External fan abnormal",
+		4: "Battery reverse connection",
+		5: "On-grid/Off-grid controller abnormal",
+		6: "PV string loss",
+		7: "Internal fan abnormal",
+		8: "DC protection unit abnormal",
+	}},
+	// SunSpec models 101-103 St and Evt1
+	"sunspec_inverter_state": {Name: "sunspec_inverter_state", Labels: map[uint64]string{
+		1: "Off",
+		2: "Sleeping",
+		3: "Starting",
+		4: "MPPT",
+		5: "Throttled",
+		6: "Shutting down",
+		7: "Fault",
+		8: "Standby",
+	}},
+	"sunspec_inverter_events": {Name: "sunspec_inverter_events", Bitmask: true, Labels: map[uint64]string{
+		0:  "Ground fault",
+		1:  "DC over voltage",
+		2:  "AC disconnect",
+		3:  "DC disconnect",
+		4:  "Grid disconnect",
+		5:  "Cabinet open",
+		6:  "Manual shutdown",
+		7:  "Over temperature",
+		8:  "Over frequency",
+		9:  "Under frequency",
+		10: "AC over voltage",
+		11: "AC under voltage",
+		12: "Blown string fuse",
+		13: "Under temperature",
+		14: "Memory loss",
+		15: "Hardware test failure",
+	}},
+}
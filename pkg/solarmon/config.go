@@ -1,6 +1,7 @@
 package solarmon
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -8,40 +9,56 @@ import (
 	"time"
 )
 
-func NewConfig(InfluxEndpoint, InfluxTags, BuildTime, GitCommit string) *Config {
+// NewConfig defines the solarmon flags on fs and parses args into a Config.
+// Nothing is registered on the global flag set, so several configs can be
+// built in the same process.
+func NewConfig(fs *flag.FlagSet, args []string, InfluxEndpoint, InfluxTags, BuildTime, GitCommit string) (*Config, error) {
 
 	config := &Config{}
 
-	flag.StringVar(&config.ModbusParity, "prty", "N", "Parity")
-	flag.IntVar(&config.StopBits, "sb", 1, "Stop Bits")
-	flag.DurationVar(&config.Timeout, "t", 1*time.Second, "Max secs to wait for single read to finish")
-	flag.IntVar(&config.DataBits, "db", 8, "Data Bits")
-	flag.IntVar(&config.BaudRate, "br", 9600, "Baud Rate")
-	flag.UintVar(&config.SlaveID, "slaveId", 1, "Slave ID")
-	flag.StringVar(&config.TTYFile, "tty", "/dev/ttyUSB0", "TTY device file/name")
-	flag.BoolVar(&config.AutoTTY, "autotty", false, "If set will search for first available TTY file in /dev/ttyUSB* in case TTYFile is missing(only linux)")
-	flag.StringVar(&config.ReadRegistersFromFile, "rfile", "", "File with registers list")
-	flag.BoolVar(&config.Once, "once", false, "Run only once and exit")
-	flag.DurationVar(&config.ReadInterval, "interval", 5*time.Second, "Seconds to wait between reads")
-	flag.BoolVar(&config.InfluxDry, "influxDry", false, "Just print influx queries on stdout")
+	fs.StringVar(&config.ModbusParity, "prty", "N", "Parity")
+	fs.IntVar(&config.StopBits, "sb", 1, "Stop Bits")
+	fs.DurationVar(&config.Timeout, "t", 1*time.Second, "Max secs to wait for single read to finish")
+	fs.IntVar(&config.DataBits, "db", 8, "Data Bits")
+	fs.IntVar(&config.BaudRate, "br", 9600, "Baud Rate")
+	fs.UintVar(&config.SlaveID, "slaveId", 1, "Slave ID")
+	fs.StringVar(&config.TTYFile, "tty", "/dev/ttyUSB0", "TTY device file/name")
+	fs.StringVar(&config.ModbusTCP, "tcp", "", "Read over Modbus TCP from host:port instead of the TTY")
+	fs.StringVar(&config.Capture, "capture", "", "Record every bus request/response to this file")
+	fs.StringVar(&config.Replay, "replay", "", "Answer reads from a -capture file instead of the bus, stops when the capture is used up")
+	fs.BoolVar(&config.AutoTTY, "autotty", false, "If set will search for first available TTY file in /dev/ttyUSB* in case TTYFile is missing(only linux)")
+	fs.StringVar(&config.TTYSelect, "ttySelect", "", "Select the TTY by adapter instead of -tty, e.g. by-id:usb-1a86*, vidpid:1a86:7523, serial:A50285BI, sysfs:*/1-1.3 (comma separated criteria must all match, only linux)")
+	fs.BoolVar(&config.ListTTY, "listtty", false, "List candidate USB serial adapters with their sysfs attributes and exit")
+	fs.IntVar(&config.DegradedAfter, "degradedAfter", 3, "Consecutive bus failures before reconnects are delayed")
+	fs.IntVar(&config.DownAfter, "downAfter", 10, "Consecutive bus failures before the link is considered down, 0 never")
+	fs.DurationVar(&config.ReconnectMin, "reconnectMin", 2*time.Second, "First reconnect delay once degraded")
+	fs.DurationVar(&config.ReconnectMax, "reconnectMax", 5*time.Minute, "Max reconnect delay")
+	fs.StringVar(&config.USBReset, "usbReset", "", "Reset the adapter when the link is down: 'sysfs' to unbind/bind the USB device, or a shell command(TTYFILE is set)")
+	fs.DurationVar(&config.ResetInterval, "usbResetInterval", 10*time.Minute, "Min time between two adapter resets")
+	fs.StringVar(&config.ReadRegistersFromFile, "rfile", "", "File with registers list")
+	fs.StringVar(&config.Profile, "profile", "", "Built-in registers to read, comma separated profiles, 'auto' picks them by the device model, 'list' shows them")
+	fs.BoolVar(&config.SunSpec, "sunspec", false, "Discover the SunSpec models of the device and read them instead of the default registers")
+	fs.IntVar(&config.DisableAfter, "disableAfter", 3, "Stop reading a register after N consecutive illegal address exceptions, 0 never stops")
+	fs.BoolVar(&config.Once, "once", false, "Run only once and exit")
+	fs.DurationVar(&config.ReadInterval, "interval", 5*time.Second, "Seconds to wait between reads")
+	fs.BoolVar(&config.InfluxDry, "influxDry", false, "Just print influx queries on stdout")
 
 	if InfluxEndpoint != "" {
-		flag.Usage = func() { fmt.Println("Solarmon ... ab@val-energy.com") }
+		fs.Usage = func() { fmt.Fprintln(fs.Output(), "Solarmon ... ab@val-energy.com") }
 
 		if InfluxEndpoint == "ENV" {
+			// credentials from VAL_INFLUX_USER and VAL_INFLUX_PASS, see resolveSecrets
 			d := os.Getenv("VAL_CUST_NAME")
-			u := os.Getenv("VAL_INFLUX_USER")
-			p := os.Getenv("VAL_INFLUX_PASS")
-			InfluxEndpoint = fmt.Sprintf(
-				"https://%s.%s:8086/write?db=db0&u=%s&p=%s", d, defaultInflxDomain, u, p,
-			)
+			InfluxEndpoint = fmt.Sprintf("https://%s.%s:8086/write?db=db0", d, defaultInflxDomain)
 		}
 
 		config.Influxdb = InfluxEndpoint
 		config.ReadInterval = 300 * time.Second
 	} else {
-		flag.StringVar(&config.Influxdb, "influxdb", "", "Influx db: http://localhost:8086/write?db=dbmae&u=user&p=pass")
+		fs.StringVar(&config.Influxdb, "influxdb", "", "Influx db: http://localhost:8086/write?db=dbmae, or SOLARMON_INFLUXDB(_FILE)")
 	}
+	fs.StringVar(&config.InfluxUser, "influxUser", "", "Influx db user, or SOLARMON_INFLUX_USER(_FILE)")
+	fs.StringVar(&config.InfluxPassword, "influxPassword", "", "Influx db password, better SOLARMON_INFLUX_PASSWORD(_FILE) or the influx_password systemd credential")
 
 	if InfluxTags != "" {
 		if InfluxTags == "ENV" {
@@ -49,42 +66,152 @@ func NewConfig(InfluxEndpoint, InfluxTags, BuildTime, GitCommit string) *Config
 		}
 		config.InfluxTags = InfluxTags
 	} else {
-		flag.StringVar(&config.InfluxTags, "influxTags", "loc=1,type=1,inverter=ktl33", "Tags to write with every measurement")
+		fs.StringVar(&config.InfluxTags, "influxTags", "loc=1,type=1,inverter=ktl33", "Tags to write with every measurement")
 	}
 
-	flag.BoolVar(&config.NMode, "nightmode", true, "Sleep during the night")
-	flag.IntVar(&config.NModeStart, "nightmodeStart", 22, "Night starts at")
-	flag.IntVar(&config.NModeEnd, "nightmodeEnd", 5, "Night ends at")
-	flag.DurationVar(&config.NModeSleepInterval, "nightmodeSleep", 5*time.Minute, "See every nightmodeSleep minutes if the night has ended")
-	flag.StringVar(&config.HTTPListen, "HTTPListen", ":8090", "HTTP listen addr")
+	fs.BoolVar(&config.NMode, "nightmode", true, "Sleep during the night")
+	fs.IntVar(&config.NModeStart, "nightmodeStart", 22, "Night starts at")
+	fs.IntVar(&config.NModeEnd, "nightmodeEnd", 5, "Night ends at")
+	fs.DurationVar(&config.NModeSleepInterval, "nightmodeSleep", 5*time.Minute, "See every nightmodeSleep minutes if the night has ended")
+	fs.StringVar(&config.SiteTZ, "tz", "Local", "Site timezone for period starts and timestamps, e.g. Europe/Sofia")
+	fs.UintVar(&config.ClockRegister, "clockReg", 0, "Inverter clock register to compare the host clock with every cycle, e.g. 40000, 0 disables")
+	fs.BoolVar(&config.ClockLocal, "clockLocal", true, "The clock register holds the site wall clock instead of UTC seconds")
+	fs.StringVar(&config.ClockSync, "clockSync", "", "Set the 'inverter' clock from the host or the 'host' clock from the inverter when they drift apart")
+	fs.DurationVar(&config.ClockMaxDrift, "clockMaxDrift", 30*time.Second, "Drift tolerated before a clock is set")
+	fs.DurationVar(&config.ClockWindow, "clockWindow", 24*time.Hour, "Largest drift corrected automatically, unless the host clock is NTP synced (-clockSync inverter) or was never set (-clockSync host)")
+	fs.BoolVar(&config.ClockHold, "clockHold", true, "With -clockReg, do not write readings while the host clock is not synced")
+	fs.DurationVar(&config.HistoryInterval, "historyInterval", time.Hour, "Upload the rfile %history files this often, besides on start and after failed cycles, 0 never")
+	fs.StringVar(&config.ReportByException, "reportByException", "", "Outputs to pass a register to only when it changed beyond its deadband or -heartbeat expired, e.g. influx")
+	fs.DurationVar(&config.Heartbeat, "heartbeat", 15*time.Minute, "With -reportByException, pass unchanged registers on at least this often, 0 never")
+	fs.StringVar(&config.Downsample, "downsample", "", "Hand outputs one summary per register and window instead of every reading, e.g. influx=5m,http=1m")
+	fs.StringVar(&config.HTTPListen, "HTTPListen", ":8090", "HTTP listen addr")
+	fs.StringVar(&config.ControlToken, "controlToken", "", "Bearer token with the control role, enables the remote control API under /api/ on the HTTP listener")
+	fs.StringVar(&config.HTTPUsers, "HTTPUsers", "", "Basic auth users of the HTTP listener, comma separated user:password:role, role is read or control")
+	fs.StringVar(&config.HTTPTokens, "HTTPTokens", "", "Bearer tokens of the HTTP listener, comma separated token:role, role is read or control")
+	fs.StringVar(&config.HTTPCert, "HTTPCert", "", "Serve HTTPS with this PEM certificate (and -HTTPKey)")
+	fs.StringVar(&config.HTTPKey, "HTTPKey", "", "PEM private key of -HTTPCert")
+	fs.BoolVar(&config.HTTPSelfSigned, "HTTPSelfSigned", false, "Serve HTTPS with a generated self signed certificate, kept in -HTTPCert/-HTTPKey when set and missing")
+	fs.StringVar(&config.InfluxCA, "influxCA", "", "PEM CA bundle to verify the influxdb server with instead of the system roots")
+	fs.BoolVar(&config.InfluxInsecure, "influxInsecure", false, "Do not verify the influxdb server certificate")
+	fs.StringVar(&config.LogLevel, "logLevel", "info", "Log level: debug, info, warn or error")
+	fs.StringVar(&config.LogFormat, "logFormat", "text", "Log format on stderr: text, json or journal (syslog priority prefixes, no timestamps)")
+	fs.DurationVar(&config.ShutdownTimeout, "shutdownTimeout", 10*time.Second, "Max time to flush outputs on exit")
+	fs.StringVar(&config.InfluxQueueFile, "influxQueueFile", "", "File to persist pending influx requests on exit and load them on start")
 
-	showVersion := flag.Bool("v", false, "show version")
+	fs.BoolVar(&config.Scan, "scan", false, "Scan the bus for slaves and answering registers, write a draft rfile and exit")
+	fs.StringVar(&config.ScanSlaveIDs, "scanIds", "1-247", "Slave IDs to probe, e.g. 1-10,15")
+	fs.StringVar(&config.ScanBaudRates, "scanBauds", "9600,19200", "Baud rates to probe")
+	fs.StringVar(&config.ScanParities, "scanParity", "N,E", "Parities to probe")
+	fs.UintVar(&config.ScanProbe, "scanProbe", 30000, "Register used to detect a slave, any answer incl. an exception counts")
+	fs.UintVar(&config.ScanFrom, "scanFrom", 32000, "First register of the sweep")
+	fs.UintVar(&config.ScanTo, "scanTo", 32400, "Last register of the sweep")
+	fs.UintVar(&config.ScanBlock, "scanBlock", 10, "Registers per sweep read")
+	fs.StringVar(&config.ScanOut, "scanOut", "", "Draft rfile to write, stdout if empty")
 
-	flag.Parse()
+	fs.BoolVar(&config.ShowVersion, "v", false, "show version")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
 
 	config.Version = fmt.Sprintf("build=%s git=%s", BuildTime, GitCommit)
 	config.StartTime = time.Now()
 
-	if config.NModeStart < 19 || config.NModeStart > 23 {
-		fmt.Printf("%s: Nightmode can only start between 19h and 23h \n", config.StartTime.Format("2006-01-02 15:04:05"))
-		os.Exit(1)
+	if config.ShowVersion {
+		return config, nil
+	}
+
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
 	}
 
-	if *showVersion {
-		fmt.Printf("%s: %s \n", config.StartTime.Format("2006-01-02 15:04:05"), config.Version)
-		os.Exit(0)
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
-	config.ReadRegistersFromCli = flag.Args()
+	loc, err := time.LoadLocation(config.SiteTZ)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %v", err)
+	}
+	config.Location = loc
+
+	config.ReadRegistersFromCli = fs.Args()
+
+	if config.Profile != "" && config.Profile != ProfileAuto && config.Profile != "list" {
+		lines, err := ProfileLines(config.Profile)
+		if err != nil {
+			return nil, err
+		}
+		config.ReadRegistersFromCli = append(lines, config.ReadRegistersFromCli...)
+	}
 
-	if len(config.ReadRegistersFromCli) == 0 && config.ReadRegistersFromFile == "" {
+	if len(config.ReadRegistersFromCli) == 0 && config.ReadRegistersFromFile == "" && config.Profile == "" {
 		config.ReadRegistersFromCli = strings.Split(defaultRfile, "\n")
 	}
 
 	config.DefaultMName = "solar"
 	config.DefaultTsType = "now"
 
-	return config
+	return config, nil
+}
+
+// DefaultConfig returns a Config holding the flag defaults, suitable as a
+// starting point when solarmon is embedded as a library.
+func DefaultConfig() (*Config, error) {
+	return NewConfig(flag.NewFlagSet("solarmon", flag.ContinueOnError), nil, "", "", "", "")
+}
+
+// resolveSecrets fills the credentials not given as flags from the
+// environment, *_FILE files or systemd credentials (see secretValue) and
+// registers them with c.Secrets.
+func (c *Config) resolveSecrets() error {
+	secrets := []struct {
+		value *string
+		env   []string
+	}{
+		{&c.Influxdb, []string{"SOLARMON_INFLUXDB"}},
+		{&c.InfluxUser, []string{"SOLARMON_INFLUX_USER", "VAL_INFLUX_USER"}},
+		{&c.InfluxPassword, []string{"SOLARMON_INFLUX_PASSWORD", "VAL_INFLUX_PASS"}},
+		{&c.ControlToken, []string{"SOLARMON_CONTROL_TOKEN"}},
+		{&c.HTTPUsers, []string{"SOLARMON_HTTP_USERS"}},
+		{&c.HTTPTokens, []string{"SOLARMON_HTTP_TOKENS"}},
+	}
+
+	for _, s := range secrets {
+		v, err := secretValue(*s.value, s.env...)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.env[0], err)
+		}
+		*s.value = v
+	}
+
+	c.Secrets = NewRedactor()
+	c.Secrets.Add("-influxPassword", c.InfluxPassword)
+	c.Secrets.Add("-controlToken", c.ControlToken)
+	for _, entry := range splitList(c.HTTPUsers) {
+		if f := strings.Split(entry, ":"); len(f) == 3 {
+			c.Secrets.Add("-HTTPUsers "+f[0], f[1])
+		}
+	}
+	for _, entry := range splitList(c.HTTPTokens) {
+		if i := strings.LastIndex(entry, ":"); i > 0 {
+			c.Secrets.Add("-HTTPTokens", entry[:i])
+		}
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.NModeStart < 19 || c.NModeStart > 23 {
+		return errors.New("nightmode can only start between 19h and 23h")
+	}
+	if c.ReconnectMin <= 0 {
+		return errors.New("reconnectMin must be positive")
+	}
+	if c.ReconnectMax < c.ReconnectMin {
+		return errors.New("reconnectMax can not be below reconnectMin")
+	}
+	return nil
 }
 
 type Config struct {
@@ -96,23 +223,77 @@ type Config struct {
 	SlaveID               uint
 	InvertorType          string
 	TTYFile               string
+	ModbusTCP             string
+	Capture               string
+	Replay                string
 	AutoTTY               bool
+	TTYSelect             string
+	ListTTY               bool
+	DegradedAfter         int
+	DownAfter             int
+	ReconnectMin          time.Duration
+	ReconnectMax          time.Duration
+	USBReset              string
+	ResetInterval         time.Duration
 	ReadRegistersFromCli  []string
 	ReadRegistersFromFile string
+	SunSpec               bool
+	Profile               string
+	DisableAfter          int
 	ReadInterval          time.Duration
 	Once                  bool
 	NMode                 bool
 	NModeStart            int
 	NModeEnd              int
 	NModeSleepInterval    time.Duration
+	SiteTZ                string
+	ClockRegister         uint
+	ClockLocal            bool
+	ClockSync             string
+	ClockMaxDrift         time.Duration
+	ClockWindow           time.Duration
+	ClockHold             bool
+	HistoryInterval       time.Duration
+	Downsample            string
+	ReportByException     string
+	Heartbeat             time.Duration
+	Location              *time.Location
 	Influxdb              string
 	InfluxTags            string
 	InfluxDry             bool
+	InfluxUser            string
+	InfluxPassword        string
+	InfluxQueueFile       string
 	HTTPListen            string
+	ControlToken          string
+	HTTPUsers             string
+	HTTPTokens            string
+	HTTPCert              string
+	HTTPKey               string
+	HTTPSelfSigned        bool
+	InfluxCA              string
+	InfluxInsecure        bool
+	ShutdownTimeout       time.Duration
+	LogLevel              string
+	LogFormat             string
+	Scan                  bool
+	ScanSlaveIDs          string
+	ScanBaudRates         string
+	ScanParities          string
+	ScanProbe             uint
+	ScanFrom              uint
+	ScanTo                uint
+	ScanBlock             uint
+	ScanOut               string
 	Version               string
 	StartTime             time.Time
+	ShowVersion           bool
 	DefaultTsType         string
 	DefaultMName          string
+
+	// Secrets hides the credentials of this configuration in its logs
+	// and outputs, set by NewConfig.
+	Secrets *Redactor
 }
 
 const defaultInflxDomain = "mon.val-energy.com"
@@ -122,7 +303,7 @@ const defaultRfile = `32080:2:active_power**:1000:I32:kW
 32082:2:reactive_power**:1000:I32:kVar
 32064:2:input_power**:1000:I32:kW
 32078:2:peak_power**:1000:I32:kW
-32114:2:eday**:100:U32:kWh:1d:eday
+32114:2:eday**:100:U32:kWh:1d/utc+5h:eday
 32106:2:etotal**:100:U32:kWh:inf:etotal
 32087:1:temp**:10:I16:C
 32086:1:efficiency:100:U16:%%
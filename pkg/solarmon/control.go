@@ -0,0 +1,229 @@
+package solarmon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ControlHandler serves the remote control API, the configuration needs
+// the read role of auth, everything else the control role:
+//
+//	POST /api/poll                     run a cycle now, returns the readings
+//	GET  /api/read?addr=&count=&type=&gain=
+//	POST /api/pause, /api/resume       stop and restart the polling loop
+//	POST /api/nightmode?enabled=       switch night mode on or off
+//	GET  /api/config                   effective configuration, secrets redacted
+func (p *Poller) ControlHandler(auth *HTTPAuth) http.Handler {
+	control := func(h http.HandlerFunc) http.Handler { return auth.Require(RoleControl, h) }
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/poll", control(p.controlPoll))
+	mux.Handle("/api/read", control(p.controlRead))
+	mux.Handle("/api/pause", control(p.controlPause(true)))
+	mux.Handle("/api/resume", control(p.controlPause(false)))
+	mux.Handle("/api/nightmode", control(p.controlNightMode))
+	mux.Handle("/api/config", auth.Require(RoleRead, http.HandlerFunc(p.controlConfig)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if role := auth.Role(r); role == RoleNone {
+			p.httpLog.Warn("control request unauthorized", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		} else {
+			p.httpLog.Info("control request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "role", role.String())
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ControlState is the answer of the state changing endpoints.
+type ControlState struct {
+	Paused    bool `json:"paused"`
+	NightMode bool `json:"nightmode"`
+}
+
+type controlReading struct {
+	Addr     uint64 `json:"addr"`
+	Name     string `json:"name,omitempty"`
+	Value    string `json:"value"`
+	Label    string `json:"label,omitempty"`
+	Unit     string `json:"unit,omitempty"`
+	Raw      string `json:"raw,omitempty"`
+	Err      string `json:"err,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	LastRead string `json:"last_read,omitempty"`
+}
+
+func readingView(r Reading) controlReading {
+	v := controlReading{Addr: r.ID, Name: r.Name, Value: r.Value, Label: r.Label, Unit: r.Unit, Disabled: r.Disabled}
+	if r.Err != nil {
+		v.Err = r.Err.Error()
+	}
+	if !r.LastRead.IsZero() {
+		v.LastRead = r.LastRead.Format(time.RFC3339)
+	}
+	return v
+}
+
+func (p *Poller) controlPoll(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	err := p.Poll(r.Context())
+	resp := struct {
+		Err      string           `json:"err,omitempty"`
+		Readings []controlReading `json:"readings"`
+	}{}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	for _, reading := range p.Snapshot() {
+		resp.Readings = append(resp.Readings, readingView(reading))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// controlRead reads count registers from addr once, type and gain default
+// to U16 and 1.
+func (p *Poller) controlRead(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	q := r.URL.Query()
+	reg, err := controlRegister(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mutex.Lock()
+	readErr := reg.ReadHR(p.transport)
+	p.mutex.Unlock()
+
+	v := readingView(reg.Reading())
+	v.Raw = hex.EncodeToString(reg.raw)
+	status := http.StatusOK
+	if readErr != nil {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, v)
+}
+
+func controlRegister(q url.Values) (*Register, error) {
+	r := NewRegister()
+	r.vtype, r.gain, r.bytesCnt, r.unit = "U16", 1, 1, "_"
+
+	var err error
+	if r.id, err = strconv.ParseUint(q.Get("addr"), 0, 16); err != nil {
+		return nil, fmt.Errorf("invalid addr %q", q.Get("addr"))
+	}
+	if c := q.Get("count"); c != "" {
+		if r.bytesCnt, err = strconv.ParseUint(c, 10, 8); err != nil || r.bytesCnt == 0 || r.bytesCnt > 125 {
+			return nil, fmt.Errorf("invalid count %q, want 1-125", c)
+		}
+	}
+	if t := q.Get("type"); t != "" {
+		r.vtype = strings.ToUpper(t)
+	}
+	if size := map[string]uint64{"I16": 1, "U16": 1, "I32": 2, "U32": 2}[r.vtype]; size > r.bytesCnt {
+		r.bytesCnt = size
+	}
+	if g := q.Get("gain"); g != "" {
+		if r.gain, err = strconv.ParseInt(g, 10, 32); err != nil || r.gain == 0 {
+			return nil, fmt.Errorf("invalid gain %q", g)
+		}
+	}
+	if u := q.Get("unit"); u != "" {
+		r.unit = u
+	}
+	r.name = fmt.Sprintf("r%d", r.id)
+	return r, nil
+}
+
+func (p *Poller) controlPause(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		p.paused.Store(pause)
+		p.wakeUp()
+		writeJSON(w, http.StatusOK, p.controlState())
+	}
+}
+
+func (p *Poller) controlNightMode(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "invalid enabled, want true or false", http.StatusBadRequest)
+		return
+	}
+	p.nmode.Store(enabled)
+	p.wakeUp()
+	writeJSON(w, http.StatusOK, p.controlState())
+}
+
+func (p *Poller) controlState() ControlState {
+	return ControlState{Paused: p.paused.Load(), NightMode: p.nmode.Load()}
+}
+
+func (p *Poller) controlConfig(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, configView(p.cfg))
+}
+
+// secretFields are replaced by REDACTED in configView when set.
+var secretFields = map[string]bool{"ControlToken": true, "HTTPUsers": true, "HTTPTokens": true, "InfluxPassword": true}
+
+// configView lists the Config fields for display, durations as text,
+// the secret fields and every other string redacted.
+func configView(cfg *Config) map[string]interface{} {
+	view := make(map[string]interface{})
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		switch f := v.Field(i).Interface().(type) {
+		case *time.Location, *Redactor:
+		case time.Duration:
+			view[name] = f.String()
+		case time.Time:
+			view[name] = f.Format(time.RFC3339)
+		case string:
+			if secretFields[name] && f != "" {
+				f = "REDACTED"
+			}
+			view[name] = cfg.Secrets.Redact(f)
+		default:
+			view[name] = f
+		}
+	}
+	return view
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
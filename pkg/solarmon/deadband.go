@@ -0,0 +1,159 @@
+package solarmon
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deadband is the report by exception setting of a register, set with an
+// rfile line
+//
+//	%deadband:register:N[%][:heartbeat]
+//
+// A reading is passed on when it moved more than N (or N percent of the
+// last value passed on) or when heartbeat expired since the last one.
+type Deadband struct {
+	Band      float64
+	Percent   bool
+	Heartbeat time.Duration
+}
+
+func ParseDeadband(band, heartbeat string) (*Deadband, error) {
+	d := &Deadband{Heartbeat: -1}
+	if strings.HasSuffix(band, "%") {
+		d.Percent, band = true, strings.TrimSuffix(band, "%")
+	}
+
+	var err error
+	if d.Band, err = strconv.ParseFloat(band, 64); err != nil || d.Band < 0 {
+		return nil, fmt.Errorf("invalid deadband %q", band)
+	}
+
+	if heartbeat != "" {
+		if d.Heartbeat, err = time.ParseDuration(heartbeat); err != nil {
+			return nil, fmt.Errorf("invalid heartbeat: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// exceeded reports whether v moved out of the band around last.
+func (d *Deadband) exceeded(last, v float64) bool {
+	band := d.Band
+	if d.Percent {
+		band = math.Abs(last) * d.Band / 100
+	}
+	if band == 0 {
+		return v != last
+	}
+	return math.Abs(v-last) > band
+}
+
+type sentValue struct {
+	value string
+	num   float64
+	at    time.Time
+}
+
+// DeadbandOutput sits in front of another output and only passes a
+// register on when its value changed beyond the register deadband (any
+// change without one) or the heartbeat expired. Failed registers, energy
+// period totals and history records are always passed on.
+type DeadbandOutput struct {
+	out       Output
+	heartbeat time.Duration
+	mutex     *sync.Mutex
+	sent      map[string]sentValue
+}
+
+// NewDeadbandOutput wraps out, heartbeat applies to registers without
+// their own, 0 disables it.
+func NewDeadbandOutput(out Output, heartbeat time.Duration) *DeadbandOutput {
+	return &DeadbandOutput{
+		out:       out,
+		heartbeat: heartbeat,
+		mutex:     &sync.Mutex{},
+		sent:      make(map[string]sentValue),
+	}
+}
+
+func (o *DeadbandOutput) WriteRegisters(data []*Register) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := cycleTime(data)
+	var changed []*Register
+	for _, r := range data {
+		if o.pass(r, now) {
+			changed = append(changed, r)
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+	return o.out.WriteRegisters(changed)
+}
+
+func (o *DeadbandOutput) pass(r *Register, now time.Time) bool {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	if r.lastErr != nil || r.disabled || r.TsType == "period" || r.TsType == "history" {
+		return true
+	}
+
+	key := r.MName + "/" + r.name
+	last, seen := o.sent[key]
+
+	d := r.deadband
+	if d == nil {
+		d = &Deadband{Heartbeat: -1}
+	}
+	heartbeat := d.Heartbeat
+	if heartbeat < 0 {
+		heartbeat = o.heartbeat
+	}
+
+	switch {
+	case !seen:
+	case heartbeat > 0 && now.Sub(last.at) >= heartbeat:
+	case r.numOK && d.exceeded(last.num, r.num):
+	case !r.numOK && r.value != last.value:
+	default:
+		return false
+	}
+
+	o.sent[key] = sentValue{value: r.value, num: r.num, at: now}
+	return true
+}
+
+func (o *DeadbandOutput) WriteEvent(e Event) error {
+	return o.out.WriteEvent(e)
+}
+
+// Unwrap returns the wrapped output.
+func (o *DeadbandOutput) Unwrap() Output {
+	return o.out
+}
+
+// Backlog passes the backlog of the wrapped output on.
+func (o *DeadbandOutput) Backlog() Backlog {
+	if r, ok := o.out.(BacklogReporter); ok {
+		return r.Backlog()
+	}
+	return Backlog{}
+}
+
+// Close closes the wrapped output.
+func (o *DeadbandOutput) Close(ctx context.Context) error {
+	if closer, ok := o.out.(OutputCloser); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
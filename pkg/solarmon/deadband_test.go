@@ -0,0 +1,73 @@
+package solarmon
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDeadbandOutput(t *testing.T) {
+	type step struct {
+		min      int
+		v        float64
+		err      error
+		disabled bool
+		want     bool
+	}
+
+	tests := []struct {
+		name     string
+		deadband *Deadband
+		steps    []step
+	}{
+		{"band", &Deadband{Band: 1, Heartbeat: -1}, []step{
+			{min: 0, v: 10, want: true},
+			{min: 1, v: 10.5},
+			{min: 2, v: 11.5, want: true},
+			{min: 3, v: 12},
+			// the heartbeat of the output
+			{min: 12, v: 12, want: true},
+			{min: 13, err: errors.New("timeout"), want: true},
+			{min: 14, disabled: true, want: true},
+			// failures left the last value passed on alone
+			{min: 15, v: 12.5},
+		}},
+		{"percent and own heartbeat", &Deadband{Band: 10, Percent: true, Heartbeat: 3 * time.Minute}, []step{
+			{min: 0, v: 100, want: true},
+			{min: 1, v: 109},
+			{min: 2, v: 89, want: true},
+			{min: 5, v: 89, want: true},
+		}},
+		{"any change without a deadband", nil, []step{
+			{min: 0, v: 1, want: true},
+			{min: 1, v: 1},
+			{min: 2, v: 1.01, want: true},
+		}},
+	}
+
+	start := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recordingOutput{}
+			o := NewDeadbandOutput(rec, 10*time.Minute)
+			r := NewRegister()
+			r.name = "active_power"
+			r.deadband = tt.deadband
+
+			for i, s := range tt.steps {
+				r.num, r.numOK, r.value = s.v, true, fmt.Sprint(s.v)
+				r.lastErr, r.disabled = s.err, s.disabled
+				r.lastRead = start.Add(time.Duration(s.min) * time.Minute)
+
+				rec.registers = nil
+				if err := o.WriteRegisters([]*Register{r}); err != nil {
+					t.Fatal(err)
+				}
+				if got := len(rec.registers) == 1; got != s.want {
+					t.Errorf("step %d at %dm: passed %v, want %v", i, s.min, got, s.want)
+				}
+			}
+		})
+	}
+}
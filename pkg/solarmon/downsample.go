@@ -0,0 +1,247 @@
+package solarmon
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AggFuncs are the window summaries a register can be reduced to.
+var AggFuncs = []string{"mean", "min", "max", "last", "sum"}
+
+// windowAcc collects the readings of one register during a window.
+type windowAcc struct {
+	src  *Register
+	n    int
+	sum  float64
+	min  float64
+	max  float64
+	last float64
+	// registers without a plain "now" timestamp are forwarded as their
+	// last reading, stamped when it was taken
+	copy *Register
+}
+
+// DownsampleOutput sits in front of another output and hands it one
+// summary per register and window instead of every reading. Windows are
+// aligned buckets in the site timezone, the summaries are stamped with the
+// window start. Numeric registers default to the mean, state registers
+// (with a code table) and undecoded ones to the last value. Points with
+// their own timestamp, like energy totals, are forwarded unchanged.
+type DownsampleOutput struct {
+	out    Output
+	window *Alignment
+	loc    *time.Location
+	mutex  *sync.Mutex
+	start  time.Time
+	accs   map[string]*windowAcc
+	order  []string
+	points []*Register
+}
+
+// NewDownsampleOutput wraps out, window is a bucket like 5m or 1h.
+func NewDownsampleOutput(out Output, window string, loc *time.Location) (*DownsampleOutput, error) {
+	a, err := ParseAlignment(window)
+	if err != nil {
+		return nil, err
+	}
+	if a.N == 0 || a.Back || a.Offset != 0 {
+		return nil, fmt.Errorf("invalid window %q, want a bucket like 5m or 1h", window)
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+
+	return &DownsampleOutput{
+		out:    out,
+		window: a,
+		loc:    loc,
+		mutex:  &sync.Mutex{},
+		accs:   make(map[string]*windowAcc),
+	}, nil
+}
+
+func (o *DownsampleOutput) WriteRegisters(data []*Register) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := cycleTime(data)
+	start, _ := o.window.Time(now, o.loc, nil)
+	if !o.start.IsZero() && !start.Equal(o.start) {
+		o.flush()
+	}
+	o.start = start
+
+	for _, r := range data {
+		o.add(r, now)
+	}
+	return nil
+}
+
+func (o *DownsampleOutput) WriteEvent(e Event) error {
+	return o.out.WriteEvent(e)
+}
+
+// Unwrap returns the wrapped output.
+func (o *DownsampleOutput) Unwrap() Output {
+	return o.out
+}
+
+// Backlog passes the backlog of the wrapped output on.
+func (o *DownsampleOutput) Backlog() Backlog {
+	if r, ok := o.out.(BacklogReporter); ok {
+		return r.Backlog()
+	}
+	return Backlog{}
+}
+
+// Close writes the summaries of the running window and closes the
+// wrapped output.
+func (o *DownsampleOutput) Close(ctx context.Context) error {
+	o.mutex.Lock()
+	o.flush()
+	o.mutex.Unlock()
+
+	if closer, ok := o.out.(OutputCloser); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
+
+func (o *DownsampleOutput) add(r *Register, now time.Time) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	if !r.ts.IsZero() {
+		o.points = append(o.points, r)
+		return
+	}
+
+	if r.lastErr != nil || r.disabled || r.TsType == "none" {
+		return
+	}
+
+	// by name, registers like clock_drift are new every cycle
+	key := r.MName + "/" + r.name
+	acc, ok := o.accs[key]
+	if !ok {
+		acc = &windowAcc{min: math.Inf(1), max: math.Inf(-1)}
+		o.accs[key] = acc
+		o.order = append(o.order, key)
+	}
+	acc.src = r
+
+	align := r.align
+	if align == nil {
+		align, _ = ParseAlignment(r.TsType)
+	}
+	if align == nil || align.N != 0 || align.Register != "" || align.Epoch || !r.numOK || r.codes != nil {
+		// take the point as it is now, stamped as influx would stamp it
+		c := *r
+		c.Mutex = &sync.Mutex{}
+		c.ts = now
+		if align != nil && align.Register == "" {
+			c.ts, _ = align.Time(now, o.loc, nil)
+		}
+		acc.copy = &c
+		return
+	}
+
+	acc.n++
+	acc.sum += r.num
+	acc.min = math.Min(acc.min, r.num)
+	acc.max = math.Max(acc.max, r.num)
+	acc.last = r.num
+}
+
+// flush hands the summaries of the finished window to the output.
+func (o *DownsampleOutput) flush() {
+	var summary []*Register
+	for _, key := range o.order {
+		acc := o.accs[key]
+		if acc.copy != nil {
+			summary = append(summary, acc.copy)
+			continue
+		}
+		if acc.n == 0 {
+			continue
+		}
+
+		funcs := acc.src.aggFuncs
+		if len(funcs) == 0 {
+			funcs = []string{"mean"}
+		}
+		for _, fn := range funcs {
+			summary = append(summary, acc.summary(fn, len(funcs) > 1, o.start))
+		}
+	}
+	summary = append(summary, o.points...)
+
+	o.accs = make(map[string]*windowAcc)
+	o.order = nil
+	o.points = nil
+
+	if len(summary) > 0 {
+		o.out.WriteRegisters(summary)
+	}
+}
+
+func (acc *windowAcc) summary(fn string, suffix bool, start time.Time) *Register {
+	var v float64
+	switch fn {
+	case "min":
+		v = acc.min
+	case "max":
+		v = acc.max
+	case "last":
+		v = acc.last
+	case "sum":
+		v = acc.sum
+	default:
+		v = acc.sum / float64(acc.n)
+	}
+
+	src := acc.src
+	src.Mutex.Lock()
+	defer src.Mutex.Unlock()
+
+	r := NewRegister()
+	r.id = src.id
+	r.name = src.name
+	if suffix {
+		base := strings.TrimRight(src.name, "* ")
+		r.name = base + "_" + fn + src.name[len(base):]
+	}
+	r.unit = src.unit
+	r.gain = 1
+	r.vtype = "F64"
+	r.num, r.numOK = math.Round(v*1e6)/1e6, true
+	r.value = fmt.Sprint(r.num)
+	r.MName = src.MName
+	r.TsType = "window"
+	r.ts = start
+	r.lastRead = start
+	return r
+}
+
+// ParseDownsample parses -downsample, e.g. "influx=5m,http=1m", into
+// windows per output name.
+func ParseDownsample(spec string) (map[string]string, error) {
+	windows := make(map[string]string)
+	if spec == "" {
+		return windows, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid -downsample entry %q, want output=window", entry)
+		}
+		windows[kv[0]] = kv[1]
+	}
+	return windows, nil
+}
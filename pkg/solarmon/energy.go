@@ -0,0 +1,125 @@
+package solarmon
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// energyTrack follows one counter register for one period.
+type energyTrack struct {
+	source  *Register
+	period  Period
+	mname   string
+	start   time.Time
+	total   float64
+	last    float64
+	lastTs  time.Time
+	partial bool
+}
+
+// EnergyAggregator turns counter registers into per period totals. It
+// emits a point for every period that closed, stamped with the period
+// start in the site timezone.
+//
+// A counter going down is taken as a reset to zero, so counters like eday
+// work as well as etotal. When readings are missing across a period
+// boundary the energy of the gap is split over the periods in proportion
+// to time. The period running when tracking started is never emitted, its
+// total would be short.
+type EnergyAggregator struct {
+	loc    *time.Location
+	tracks []*energyTrack
+}
+
+// NewEnergyAggregator tracks the registers having %energy periods, it
+// returns nil when there are none.
+func NewEnergyAggregator(registers []*Register, loc *time.Location) *EnergyAggregator {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	a := &EnergyAggregator{loc: loc}
+	for _, r := range registers {
+		for _, p := range r.energyPeriods {
+			a.tracks = append(a.tracks, &energyTrack{
+				source: r,
+				period: p,
+				mname:  fmt.Sprintf("%s_%s", r.energyMName, p),
+			})
+		}
+	}
+
+	if len(a.tracks) == 0 {
+		return nil
+	}
+	return a
+}
+
+// Update adds the values of the cycle read at now and returns the totals
+// of the periods that closed.
+func (a *EnergyAggregator) Update(now time.Time) []*Register {
+	var closed []*Register
+	for _, t := range a.tracks {
+		v, ok := t.source.numeric()
+		if !ok {
+			continue
+		}
+
+		if t.lastTs.IsZero() {
+			t.start = t.period.Start(now, a.loc)
+			t.partial = !t.start.Equal(now)
+			t.last, t.lastTs = v, now
+			continue
+		}
+
+		delta := v - t.last
+		if delta < 0 {
+			delta = v
+		}
+
+		from := t.lastTs
+		for {
+			end := t.period.Next(t.start, a.loc)
+			if now.Before(end) {
+				t.total += delta
+				break
+			}
+
+			share := delta
+			if span := now.Sub(from); span > 0 {
+				share = delta * float64(end.Sub(from)) / float64(span)
+			}
+			t.total += share
+			delta -= share
+
+			if !t.partial {
+				closed = append(closed, t.point(now))
+			}
+
+			from, t.start, t.total, t.partial = end, end, 0, false
+		}
+		t.last, t.lastTs = v, now
+	}
+	return closed
+}
+
+// point is the closed period as a register, ready for the outputs.
+func (t *energyTrack) point(now time.Time) *Register {
+	t.source.Mutex.Lock()
+	defer t.source.Mutex.Unlock()
+
+	r := NewRegister()
+	r.id = t.source.id
+	r.name = t.source.name
+	r.unit = t.source.unit
+	r.gain = 1
+	r.vtype = "F64"
+	r.num, r.numOK = math.Round(t.total*1e6)/1e6, true
+	r.value = fmt.Sprint(r.num)
+	r.MName = t.mname
+	r.TsType = "period"
+	r.ts = t.start
+	r.lastRead = now
+	return r
+}
@@ -0,0 +1,75 @@
+package solarmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnergyAggregator(t *testing.T) {
+	loc := site(t)
+	at := func(d, h int) time.Time {
+		return time.Date(2024, time.June, d, h, 0, 0, 0, loc)
+	}
+	type reading struct {
+		at time.Time
+		v  float64
+	}
+	type point struct {
+		start time.Time
+		total float64
+	}
+
+	tests := []struct {
+		name     string
+		readings []reading
+		want     []point
+	}{
+		{"accumulates", []reading{{at(1, 0), 100}, {at(1, 12), 110}, {at(1, 23), 125}, {at(2, 0), 130}},
+			[]point{{at(1, 0), 30}}},
+		// the first day started before tracking, only the second is whole
+		{"partial first day", []reading{{at(1, 10), 100}, {at(2, 0), 120}, {at(3, 0), 150}},
+			[]point{{at(2, 0), 30}}},
+		// eday restarts at zero, the gap over midnight is split in half
+		{"reset", []reading{{at(1, 0), 0}, {at(1, 23), 15}, {at(2, 1), 2}, {at(3, 0), 9}},
+			[]point{{at(1, 0), 16}, {at(2, 0), 8}}},
+		{"wrap", []reading{{at(1, 0), 65530}, {at(1, 12), 65535}, {at(1, 18), 4}, {at(2, 0), 10}},
+			[]point{{at(1, 0), 15}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegister()
+			r.name = "etotal"
+			r.energyPeriods = []Period{PeriodDay}
+			r.energyMName = "energy"
+			a := NewEnergyAggregator([]*Register{r}, loc)
+
+			var got []point
+			for _, rd := range tt.readings {
+				r.num, r.numOK = rd.v, true
+				for _, p := range a.Update(rd.at) {
+					if p.MName != "energy_day" {
+						t.Errorf("measurement: got %s, want energy_day", p.MName)
+					}
+					got = append(got, point{p.ts, p.num})
+				}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				// midnight at the site, not on the host
+				if !got[i].start.Equal(tt.want[i].start) || got[i].total != tt.want[i].total {
+					t.Errorf("point %d: got %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEnergyAggregatorNone(t *testing.T) {
+	if a := NewEnergyAggregator([]*Register{NewRegister()}, nil); a != nil {
+		t.Errorf("got %v, want nil without energy periods", a)
+	}
+}
@@ -0,0 +1,139 @@
+package solarmon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+type ErrClass string
+
+const (
+	ErrClassTimeout     ErrClass = "timeout"
+	ErrClassFraming     ErrClass = "framing"
+	ErrClassException   ErrClass = "exception"
+	ErrClassPortMissing ErrClass = "port_missing"
+	ErrClassTransport   ErrClass = "transport"
+	ErrClassBackoff     ErrClass = "backoff"
+	// ErrClassInvalid marks readings rejected by the register checks
+	ErrClassInvalid ErrClass = "invalid"
+)
+
+// ErrClasses lists every class, in the order they are reported.
+var ErrClasses = []ErrClass{
+	ErrClassTimeout, ErrClassFraming, ErrClassException, ErrClassPortMissing, ErrClassTransport, ErrClassBackoff,
+	ErrClassInvalid,
+}
+
+// BusOp is the request a BusError failed on.
+type BusOp string
+
+const (
+	OpRead   BusOp = "read"
+	OpWrite  BusOp = "write"
+	OpUpload BusOp = "upload"
+	// OpCheck is a read answered with a value the register checks reject
+	OpCheck BusOp = "check"
+)
+
+// BusError is returned by transports for failed requests, an empty Op is
+// a read. Code holds the modbus exception code for ErrClassException.
+type BusError struct {
+	Class ErrClass
+	Op    BusOp
+	Code  byte
+	Addr  uint16
+	Err   error
+}
+
+func (e *BusError) Error() string {
+	switch e.Op {
+	case OpWrite:
+		return fmt.Sprintf("%s: unable to write hregister %v: %v", e.Class, e.Addr, e.Err)
+	case OpUpload:
+		return fmt.Sprintf("%s: unable to upload file: %v", e.Class, e.Err)
+	case OpCheck:
+		return fmt.Sprintf("%s: hregister %v rejected: %v", e.Class, e.Addr, e.Err)
+	}
+	return fmt.Sprintf("%s: unable to read hregister %v: %v", e.Class, e.Addr, e.Err)
+}
+
+func (e *BusError) Unwrap() error {
+	return e.Err
+}
+
+// TransportLevel reports whether the link itself failed, as opposed to the
+// device rejecting the request.
+func (e *BusError) TransportLevel() bool {
+	return e.Class != ErrClassException && e.Class != ErrClassInvalid
+}
+
+// IllegalAddress reports whether the device rejected the address.
+func (e *BusError) IllegalAddress() bool {
+	return e.Class == ErrClassException && e.Code == modbus.ExceptionCodeIllegalDataAddress
+}
+
+func NewBusError(op BusOp, addr uint16, err error) *BusError {
+	var busErr *BusError
+	if errors.As(err, &busErr) {
+		e := *busErr
+		e.Op, e.Addr = op, addr
+		return &e
+	}
+
+	e := &BusError{Op: op, Addr: addr, Err: err, Class: ClassifyError(err)}
+	if code, ok := exceptionCode(err); ok {
+		e.Code = code
+	}
+	return e
+}
+
+// ClassifyError maps the errors returned by the modbus and serial packages
+// to an ErrClass. The modbus package reports framing problems as plain
+// formatted errors, so those are matched by text.
+func ClassifyError(err error) ErrClass {
+	var busErr *BusError
+	if errors.As(err, &busErr) {
+		return busErr.Class
+	}
+
+	if _, ok := exceptionCode(err); ok {
+		return ErrClassException
+	}
+
+	if errors.Is(err, errBackoff) {
+		return ErrClassBackoff
+	}
+
+	if errors.Is(err, serial.ErrTimeout) {
+		return ErrClassTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrClassTimeout
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrClassPortMissing
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrClassFraming
+	}
+
+	msg := err.Error()
+	for _, s := range []string{"crc", "does not meet minimum", "does not match", "response length", "is empty"} {
+		if strings.Contains(msg, s) {
+			return ErrClassFraming
+		}
+	}
+
+	return ErrClassTransport
+}
@@ -0,0 +1,186 @@
+package solarmon
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event is an operational event handed to the outputs next to the
+// readings, see Output.WriteEvent. Outputs switch on the concrete type,
+// String is the text form for the console and the HTTP page.
+type Event interface {
+	EventTime() time.Time
+	String() string
+}
+
+// CycleCompleted ends every poll cycle. Held is set when the readings were
+// not written because the host clock is not synced. Errors counts the
+// failed registers per error class and Disabled the registers disabled
+// after illegal address exceptions, taken before any output wrapper drops
+// or summarises them.
+type CycleCompleted struct {
+	At        time.Time
+	Read      time.Duration
+	Write     time.Duration
+	Failed    int
+	Registers int
+	Held      bool
+	Errors    map[ErrClass]int
+	Disabled  int
+}
+
+func (e CycleCompleted) EventTime() time.Time { return e.At }
+
+func (e CycleCompleted) String() string {
+	s := fmt.Sprintf("%s, %s; failed=%d/%d", e.Read, e.Write, e.Failed, e.Registers)
+	if e.Held {
+		s += " (host clock not synced yet, readings not written)"
+	}
+	return s
+}
+
+// NightModeEntered is sent once when polling pauses for the night.
+type NightModeEntered struct {
+	At    time.Time
+	Start int
+	End   int
+}
+
+func (e NightModeEntered) EventTime() time.Time { return e.At }
+
+func (e NightModeEntered) String() string {
+	return fmt.Sprintf("Nightmode from %d to %d", e.Start, e.End)
+}
+
+// NightModeExited is sent when polling resumes in the morning.
+type NightModeExited struct {
+	At time.Time
+}
+
+func (e NightModeExited) EventTime() time.Time { return e.At }
+
+func (e NightModeExited) String() string {
+	return "Nightmode ended"
+}
+
+// TransportError reports a change of the transport link state, State is
+// HealthHealthy once the link recovered.
+type TransportError struct {
+	At          time.Time
+	State       HealthState
+	Failures    int
+	NextAttempt time.Time
+	Err         error
+}
+
+func (e TransportError) EventTime() time.Time { return e.At }
+
+func (e TransportError) String() string {
+	if e.State == HealthHealthy {
+		return fmt.Sprintf("Bus %s", e.State)
+	}
+	return fmt.Sprintf(
+		"Bus %s: failures=%d next_attempt=%s err=%v",
+		e.State, e.Failures, e.NextAttempt.Format("15:04:05"), e.Err,
+	)
+}
+
+// QueueBacklog reports a change of the data an output could not deliver
+// yet, see BacklogReporter.
+type QueueBacklog struct {
+	At     time.Time
+	Output string
+	Backlog
+}
+
+func (e QueueBacklog) EventTime() time.Time { return e.At }
+
+func (e QueueBacklog) String() string {
+	return fmt.Sprintf("Queue %s: pending=%d/%d dropped=%d", e.Output, e.Pending, e.Max, e.Dropped)
+}
+
+// Backlog is the queue state of an output.
+type Backlog struct {
+	Pending int
+	Max     int
+	Dropped int
+}
+
+// BacklogReporter is implemented by outputs queueing what they could not
+// deliver. Wrapping outputs pass it through.
+type BacklogReporter interface {
+	Backlog() Backlog
+}
+
+// AlarmRaised is sent when a bit of an alarm register (%alarm rfile line)
+// is set, AlarmCleared when it is reset.
+type AlarmRaised struct {
+	At       time.Time
+	Register string
+	Bit      uint
+	Label    string
+}
+
+func (e AlarmRaised) EventTime() time.Time { return e.At }
+
+func (e AlarmRaised) String() string {
+	return fmt.Sprintf("Alarm %s: %s raised", e.Register, e.Label)
+}
+
+type AlarmCleared struct {
+	At       time.Time
+	Register string
+	Bit      uint
+	Label    string
+}
+
+func (e AlarmCleared) EventTime() time.Time { return e.At }
+
+func (e AlarmCleared) String() string {
+	return fmt.Sprintf("Alarm %s: %s cleared", e.Register, e.Label)
+}
+
+// alarmState follows the bits of the alarm registers between cycles.
+type alarmState struct {
+	registers []*Register
+	bits      map[*Register]uint64
+}
+
+func newAlarmState(registers []*Register) *alarmState {
+	a := &alarmState{bits: make(map[*Register]uint64)}
+	for _, r := range registers {
+		if r.alarm {
+			a.registers = append(a.registers, r)
+		}
+	}
+	if len(a.registers) == 0 {
+		return nil
+	}
+	return a
+}
+
+// Update compares the alarm registers read in the cycle with the previous
+// ones. Alarms active on the first read are raised, failed reads keep the
+// previous state.
+func (a *alarmState) Update(now time.Time) []Event {
+	var events []Event
+	for _, r := range a.registers {
+		bits, ok := r.alarmBits()
+		if !ok {
+			continue
+		}
+
+		prev := a.bits[r]
+		a.bits[r] = bits
+		for bit := uint(0); bit < 64; bit++ {
+			mask := uint64(1) << bit
+			switch {
+			case bits&mask != 0 && prev&mask == 0:
+				events = append(events, AlarmRaised{At: now, Register: r.name, Bit: bit, Label: r.bitLabel(bit)})
+			case bits&mask == 0 && prev&mask != 0:
+				events = append(events, AlarmCleared{At: now, Register: r.name, Bit: bit, Label: r.bitLabel(bit)})
+			}
+		}
+	}
+	return events
+}
@@ -0,0 +1,208 @@
+package solarmon
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expr is a parsed derived register expression: numbers, register names,
+// + - * /, parentheses and the functions abs, sqrt, min, max and pow.
+type Expr struct {
+	src   string
+	root  ast.Expr
+	names []string
+}
+
+func ParseExpr(src string) (*Expr, error) {
+	root, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", src, err)
+	}
+
+	e := &Expr{src: src, root: root}
+	if err := e.collect(root); err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", src, err)
+	}
+	return e, nil
+}
+
+// collect validates the syntax tree and records the names it references.
+func (e *Expr) collect(n ast.Expr) error {
+	switch v := n.(type) {
+	case *ast.BasicLit:
+		return nil
+	case *ast.Ident:
+		for _, name := range e.names {
+			if name == v.Name {
+				return nil
+			}
+		}
+		e.names = append(e.names, v.Name)
+		return nil
+	case *ast.ParenExpr:
+		return e.collect(v.X)
+	case *ast.UnaryExpr:
+		if v.Op != token.ADD && v.Op != token.SUB {
+			return fmt.Errorf("unsupported operator %s", v.Op)
+		}
+		return e.collect(v.X)
+	case *ast.BinaryExpr:
+		switch v.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO:
+		default:
+			return fmt.Errorf("unsupported operator %s", v.Op)
+		}
+		if err := e.collect(v.X); err != nil {
+			return err
+		}
+		return e.collect(v.Y)
+	case *ast.CallExpr:
+		fn, ok := v.Fun.(*ast.Ident)
+		if !ok || exprFuncs[fn.Name] == nil {
+			return errors.New("unknown function")
+		}
+		for _, arg := range v.Args {
+			if err := e.collect(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New("unsupported syntax")
+}
+
+// Names returns the register names the expression depends on.
+func (e *Expr) Names() []string {
+	return e.names
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+func (e *Expr) Eval(vars map[string]float64) (float64, error) {
+	return evalNode(e.root, vars)
+}
+
+var exprFuncs = map[string]func(args []float64) (float64, error){
+	"abs":  func(a []float64) (float64, error) { return unary(a, math.Abs) },
+	"sqrt": func(a []float64) (float64, error) { return unary(a, math.Sqrt) },
+	"min": func(a []float64) (float64, error) {
+		if len(a) == 0 {
+			return 0, errors.New("min needs arguments")
+		}
+		v := a[0]
+		for _, x := range a[1:] {
+			v = math.Min(v, x)
+		}
+		return v, nil
+	},
+	"max": func(a []float64) (float64, error) {
+		if len(a) == 0 {
+			return 0, errors.New("max needs arguments")
+		}
+		v := a[0]
+		for _, x := range a[1:] {
+			v = math.Max(v, x)
+		}
+		return v, nil
+	},
+	"pow": func(a []float64) (float64, error) {
+		if len(a) != 2 {
+			return 0, errors.New("pow needs 2 arguments")
+		}
+		return math.Pow(a[0], a[1]), nil
+	},
+}
+
+func unary(a []float64, fn func(float64) float64) (float64, error) {
+	if len(a) != 1 {
+		return 0, errors.New("function needs 1 argument")
+	}
+	return fn(a[0]), nil
+}
+
+func evalNode(n ast.Expr, vars map[string]float64) (float64, error) {
+	switch v := n.(type) {
+	case *ast.BasicLit:
+		if v.Kind != token.INT && v.Kind != token.FLOAT {
+			return 0, fmt.Errorf("unsupported literal %s", v.Value)
+		}
+		return strconv.ParseFloat(strings.Replace(v.Value, "_", "", -1), 64)
+	case *ast.Ident:
+		x, ok := vars[v.Name]
+		if !ok {
+			return 0, fmt.Errorf("%s is unavailable", v.Name)
+		}
+		return x, nil
+	case *ast.ParenExpr:
+		return evalNode(v.X, vars)
+	case *ast.UnaryExpr:
+		x, err := evalNode(v.X, vars)
+		if err != nil {
+			return 0, err
+		}
+		switch v.Op {
+		case token.SUB:
+			return -x, nil
+		case token.ADD:
+			return x, nil
+		}
+	case *ast.BinaryExpr:
+		x, err := evalNode(v.X, vars)
+		if err != nil {
+			return 0, err
+		}
+		y, err := evalNode(v.Y, vars)
+		if err != nil {
+			return 0, err
+		}
+		switch v.Op {
+		case token.ADD:
+			return finite(x+y, "sum")
+		case token.SUB:
+			return finite(x-y, "difference")
+		case token.MUL:
+			return finite(x*y, "product")
+		case token.QUO:
+			if y == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return finite(x/y, "quotient")
+		}
+	case *ast.CallExpr:
+		args := make([]float64, 0, len(v.Args))
+		for _, a := range v.Args {
+			x, err := evalNode(a, vars)
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, x)
+		}
+		name := v.Fun.(*ast.Ident).Name
+		x, err := exprFuncs[name](args)
+		if err != nil {
+			return 0, err
+		}
+		return finite(x, name)
+	}
+	return 0, fmt.Errorf("unsupported expression")
+}
+
+// finite rejects the NaN and infinite results of sqrt of a negative
+// number, pow or an overflow, influx refuses them.
+func finite(x float64, what string) (float64, error) {
+	if math.IsNaN(x) {
+		return 0, fmt.Errorf("%s is not a number", what)
+	}
+	if math.IsInf(x, 0) {
+		return 0, fmt.Errorf("%s overflows", what)
+	}
+	return x, nil
+}
@@ -0,0 +1,58 @@
+package solarmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExprEval(t *testing.T) {
+	vars := map[string]float64{"p": 4, "neg": -1, "zero": 0, "big": 1e200}
+
+	tests := []struct {
+		expr string
+		want float64
+		err  bool
+	}{
+		{expr: "sqrt(p) + 1", want: 3},
+		{expr: "p / 2 * (1 - neg)", want: 4},
+		{expr: "max(p, neg, 2)", want: 4},
+		{expr: "p / zero", err: true},
+		{expr: "sqrt(neg)", err: true},
+		{expr: "pow(neg, 0.5)", err: true},
+		{expr: "pow(big, 2)", err: true},
+		{expr: "big * big", err: true},
+		{expr: "-big * big - big * big", err: true},
+		{expr: "p + missing", err: true},
+	}
+
+	for _, tt := range tests {
+		e, err := ParseExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		got, err := e.Eval(vars)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.expr, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %v %v, want %v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestDerivedNotFinite(t *testing.T) {
+	r := NewRegister()
+	r.name = "root"
+	r.expr, _ = ParseExpr("sqrt(neg)")
+
+	r.evaluate(map[string]float64{"neg": -1}, time.Now())
+	if _, ok := r.numeric(); ok {
+		t.Error("numeric: got a value, want none")
+	}
+	if r.Reading().Err == nil {
+		t.Error("Err: got nil, want the failed computation")
+	}
+}
@@ -0,0 +1,204 @@
+package solarmon
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type HealthState string
+
+const (
+	HealthHealthy  HealthState = "healthy"
+	HealthDegraded HealthState = "degraded"
+	HealthDown     HealthState = "down"
+)
+
+// HealthStatus is a copy of the supervisor state.
+type HealthStatus struct {
+	State       HealthState
+	Failures    int
+	NextAttempt time.Time
+	LastReset   time.Time
+	LastErr     error
+}
+
+// HealthReporter is implemented by transports supervising their link.
+type HealthReporter interface {
+	Health() HealthStatus
+}
+
+var errBackoff = errors.New("waiting before next reconnect")
+
+// Supervisor tracks consecutive transport failures. Below degradedAfter
+// failures reconnects happen right away, then they are delayed with an
+// exponential, jittered backoff. Reaching downAfter marks the link down and
+// runs the reset hook, at most once per resetInterval.
+type Supervisor struct {
+	mutex         *sync.Mutex
+	state         HealthState
+	failures      int
+	degradedAfter int
+	downAfter     int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	nextAttempt   time.Time
+	lastErr       error
+	resetHook     func() error
+	resetInterval time.Duration
+	lastReset     time.Time
+}
+
+func NewSupervisor(cfg *Config, resetHook func() error) *Supervisor {
+	return &Supervisor{
+		mutex:         &sync.Mutex{},
+		state:         HealthHealthy,
+		degradedAfter: cfg.DegradedAfter,
+		downAfter:     cfg.DownAfter,
+		minBackoff:    cfg.ReconnectMin,
+		maxBackoff:    cfg.ReconnectMax,
+		resetHook:     resetHook,
+		resetInterval: cfg.ResetInterval,
+	}
+}
+
+// Allow reports whether a reconnect may be attempted now.
+func (s *Supervisor) Allow() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if wait := time.Until(s.nextAttempt); wait > 0 {
+		return fmt.Errorf("%w, %s left", errBackoff, wait.Round(time.Second))
+	}
+	return nil
+}
+
+func (s *Supervisor) Success() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state = HealthHealthy
+	s.failures = 0
+	s.nextAttempt = time.Time{}
+	s.lastErr = nil
+}
+
+func (s *Supervisor) Failure(err error) {
+	s.mutex.Lock()
+
+	s.failures++
+	s.lastErr = err
+
+	if s.failures < s.degradedAfter {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.state = HealthDegraded
+	if s.downAfter > 0 && s.failures >= s.downAfter {
+		s.state = HealthDown
+	}
+
+	s.nextAttempt = time.Now().Add(s.backoff())
+
+	reset := s.state == HealthDown && s.resetHook != nil && time.Since(s.lastReset) >= s.resetInterval
+	if reset {
+		s.lastReset = time.Now()
+	}
+	s.mutex.Unlock()
+
+	if !reset {
+		return
+	}
+
+	if err := s.resetHook(); err != nil {
+		s.mutex.Lock()
+		s.lastErr = fmt.Errorf("usb reset failed: %v (after %v)", err, s.lastErr)
+		s.mutex.Unlock()
+	}
+}
+
+// backoff doubles with every failure past degradedAfter, capped at
+// maxBackoff, and is spread by up to +-20% so several daemons sharing a
+// hub do not retry in lockstep.
+func (s *Supervisor) backoff() time.Duration {
+	d := s.minBackoff
+	for i := s.degradedAfter; i < s.failures && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.maxBackoff {
+		d = s.maxBackoff
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(d)/5+1)) * 2
+	return d - d/5 + jitter
+}
+
+func (s *Supervisor) Health() HealthStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return HealthStatus{
+		State:       s.state,
+		Failures:    s.failures,
+		NextAttempt: s.nextAttempt,
+		LastReset:   s.lastReset,
+		LastErr:     s.lastErr,
+	}
+}
+
+// NewResetHook returns the reset hook for the -usbReset option: "sysfs"
+// unbinds and rebinds the USB device behind the tty, anything else is run
+// as a shell command with TTYFILE in its environment.
+func NewResetHook(spec string, tty func() string) func() error {
+	switch spec {
+	case "":
+		return nil
+	case "sysfs":
+		usbDevice, _ := usbDeviceOf(tty())
+		return func() error {
+			// The tty vanishes with a hung adapter, keep the last known device
+			if dev, err := usbDeviceOf(tty()); err == nil {
+				usbDevice = dev
+			}
+			if usbDevice == "" {
+				return fmt.Errorf("unable to find usb device of %s", tty())
+			}
+			return rebindUSB(usbDevice)
+		}
+	default:
+		return func() error {
+			cmd := exec.Command("/bin/sh", "-c", spec)
+			cmd.Env = append(os.Environ(), "TTYFILE="+tty())
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%v: %s", err, out)
+			}
+			return nil
+		}
+	}
+}
+
+// usbDeviceOf resolves /dev/ttyUSB0 to its USB device name, e.g. "1-1.3"
+func usbDeviceOf(tty string) (string, error) {
+	dir, err := usbDeviceDir(tty)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(dir), nil
+}
+
+func rebindUSB(device string) error {
+	const driver = "/sys/bus/usb/drivers/usb/"
+	if err := ioutil.WriteFile(driver+"unbind", []byte(device), 0200); err != nil {
+		return err
+	}
+	time.Sleep(time.Second)
+	return ioutil.WriteFile(driver+"bind", []byte(device), 0200)
+}
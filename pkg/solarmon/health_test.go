@@ -0,0 +1,47 @@
+package solarmon
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestSupervisorBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		min, max time.Duration
+		want     time.Duration
+	}{
+		{failures: 3, min: 2 * time.Second, max: time.Minute, want: 2 * time.Second},
+		{failures: 4, min: 2 * time.Second, max: time.Minute, want: 4 * time.Second},
+		{failures: 7, min: 2 * time.Second, max: time.Minute, want: 32 * time.Second},
+		{failures: 8, min: 2 * time.Second, max: time.Minute, want: time.Minute},
+		{failures: 1000, min: 2 * time.Second, max: time.Minute, want: time.Minute},
+		{failures: 5, min: time.Second, max: time.Second, want: time.Second},
+		{failures: 5, min: time.Nanosecond, max: time.Nanosecond, want: time.Nanosecond},
+	}
+
+	for _, tt := range tests {
+		s := NewSupervisor(&Config{DegradedAfter: 3, ReconnectMin: tt.min, ReconnectMax: tt.max}, nil)
+		s.failures = tt.failures
+		for i := 0; i < 50; i++ {
+			// +-20% jitter
+			if got := s.backoff(); got < tt.want-tt.want/5 || got > tt.want+tt.want/5 {
+				t.Errorf("%d failures, %s to %s: got %s, want %s +-20%%", tt.failures, tt.min, tt.max, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestConfigReconnectBounds(t *testing.T) {
+	for _, args := range [][]string{
+		{"-reconnectMin", "0"},
+		{"-reconnectMin", "-1s"},
+		{"-reconnectMin", "10s", "-reconnectMax", "5s"},
+	} {
+		if _, err := NewConfig(flag.NewFlagSet("test", flag.ContinueOnError), args, "", "", "", ""); err == nil {
+			t.Errorf("%v: got no error", args)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package solarmon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryFile is a file uploaded from the device with the Huawei 0x41
+// function and cut into fixed size records, set with rfile lines
+//
+//	%history:name:file type:record size:timestamp offset[:measurement]
+//	%hfield:name:offset:field:gain:type:unit
+//
+// The record timestamp is U32 device seconds, like the clock register.
+type HistoryFile struct {
+	Name       string
+	FileType   byte
+	RecordSize int
+	TsOffset   int
+	MName      string
+	Fields     []*Register
+	// newest record handed out so far
+	latest time.Time
+}
+
+// GetHistoryFiles returns the history files of the rfile, nil without.
+func GetHistoryFiles(cfg *Config) ([]*HistoryFile, error) {
+	lines, err := rfileLines(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*HistoryFile
+	byName := make(map[string]*HistoryFile)
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "%history:") {
+			continue
+		}
+		f, err := parseHistoryFile(cfg, line)
+		if err != nil {
+			return nil, err
+		}
+		if byName[f.Name] != nil {
+			return nil, fmt.Errorf("history file %s defined twice", f.Name)
+		}
+		byName[f.Name] = f
+		files = append(files, f)
+	}
+
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "%hfield:") {
+			continue
+		}
+		h := strings.Split(line, ":")
+		if len(h) != 7 {
+			return nil, fmt.Errorf("invalid hfield line %q, want %%hfield:file:offset:field:gain:type:unit", line)
+		}
+		f := byName[h[1]]
+		if f == nil {
+			return nil, fmt.Errorf("hfield %s: unknown history file %s", h[3], h[1])
+		}
+		r, err := parseHistoryField(f, h[2:])
+		if err != nil {
+			return nil, fmt.Errorf("hfield %s: %v", h[3], err)
+		}
+		f.Fields = append(f.Fields, r)
+	}
+
+	for _, f := range files {
+		if len(f.Fields) == 0 {
+			return nil, fmt.Errorf("history file %s has no fields", f.Name)
+		}
+	}
+	return files, nil
+}
+
+func parseHistoryFile(cfg *Config, line string) (*HistoryFile, error) {
+	h := strings.Split(line, ":")
+	if len(h) != 5 && len(h) != 6 {
+		return nil, fmt.Errorf("invalid history line %q, want %%history:name:file type:record size:timestamp offset[:measurement]", line)
+	}
+
+	f := &HistoryFile{Name: h[1], MName: cfg.DefaultMName}
+	fileType, err := strconv.ParseUint(h[2], 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("history %s: invalid file type %q", f.Name, h[2])
+	}
+	f.FileType = byte(fileType)
+
+	if f.RecordSize, err = strconv.Atoi(h[3]); err != nil || f.RecordSize < 4 {
+		return nil, fmt.Errorf("history %s: invalid record size %q", f.Name, h[3])
+	}
+	if f.TsOffset, err = strconv.Atoi(h[4]); err != nil || f.TsOffset < 0 || f.TsOffset+4 > f.RecordSize {
+		return nil, fmt.Errorf("history %s: invalid timestamp offset %q", f.Name, h[4])
+	}
+	if len(h) == 6 && h[5] != "" {
+		f.MName = h[5]
+	}
+	return f, nil
+}
+
+// parseHistoryField parses offset:field:gain:type:unit into a register
+// used as a template for every record.
+func parseHistoryField(f *HistoryFile, h []string) (*Register, error) {
+	offset, err := strconv.Atoi(h[0])
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("invalid offset %q", h[0])
+	}
+
+	size := map[string]int{"I16": 2, "U16": 2, "I32": 4, "U32": 4}[h[3]]
+	if size == 0 {
+		return nil, fmt.Errorf("invalid type %q, want I16, U16, I32 or U32", h[3])
+	}
+	if offset+size > f.RecordSize {
+		return nil, fmt.Errorf("offset %d past the %d byte record", offset, f.RecordSize)
+	}
+
+	r := NewRegister()
+	r.id = uint64(offset)
+	r.bytesCnt = uint64(size / 2)
+	r.name = h[1]
+	if r.gain, err = strconv.ParseInt(h[2], 10, 32); err != nil || r.gain == 0 {
+		return nil, fmt.Errorf("invalid gain %q", h[2])
+	}
+	r.vtype = h[3]
+	r.unit = h[4]
+	r.MName = f.MName
+	r.TsType = "history"
+	return r, nil
+}
+
+// Records decodes file into registers stamped with their record time,
+// skipping records not newer than the ones handed out before and empty
+// ones (timestamp 0 or 0xFFFFFFFF).
+func (f *HistoryFile) Records(file []byte, local bool, loc *time.Location) []*Register {
+	var registers []*Register
+	latest := f.latest
+
+	for off := 0; off+f.RecordSize <= len(file); off += f.RecordSize {
+		rec := file[off : off+f.RecordSize]
+		v := binary.BigEndian.Uint32(rec[f.TsOffset:])
+		if v == 0 || v == ^uint32(0) {
+			continue
+		}
+
+		ts := deviceTime(v, local, loc)
+		if !ts.After(f.latest) {
+			continue
+		}
+		if ts.After(latest) {
+			latest = ts
+		}
+
+		for _, field := range f.Fields {
+			r := NewRegister()
+			r.id = field.id
+			r.name = field.name
+			r.gain = field.gain
+			r.vtype = field.vtype
+			r.unit = field.unit
+			r.MName = field.MName
+			r.TsType = field.TsType
+			r.raw = rec[field.id : field.id+field.bytesCnt*2]
+			r.ParseResult()
+			r.ts = ts
+			r.lastRead = ts
+			registers = append(registers, r)
+		}
+	}
+
+	f.latest = latest
+	return registers
+}
+
+// History uploads the history files on start, after the bus recovered
+// from failed cycles and every interval, and hands out the new records.
+type History struct {
+	files    []*HistoryFile
+	local    bool
+	loc      *time.Location
+	interval time.Duration
+	last     time.Time
+}
+
+// NewHistory returns nil when the rfile defines no history files.
+func NewHistory(cfg *Config) (*History, error) {
+	files, err := GetHistoryFiles(cfg)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	return &History{files: files, local: cfg.ClockLocal, loc: loc, interval: cfg.HistoryInterval}, nil
+}
+
+// Due reports whether the files should be uploaded now, recovered is set
+// on the first good cycle after failed ones.
+func (h *History) Due(now time.Time, recovered bool) bool {
+	return h.last.IsZero() || recovered || (h.interval > 0 && now.Sub(h.last) >= h.interval)
+}
+
+// Fetch uploads every file and returns the records not handed out yet.
+// A failed file is retried when the history is due next.
+func (h *History) Fetch(t Transport, now time.Time) ([]*Register, error) {
+	h.last = now
+
+	var registers []*Register
+	var errs []string
+	for _, f := range h.files {
+		file, err := UploadFile(t, f.FileType)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", f.Name, err))
+			continue
+		}
+		registers = append(registers, f.Records(file, h.local, h.loc)...)
+	}
+
+	if len(errs) > 0 {
+		return registers, fmt.Errorf("history %s", strings.Join(errs, "; "))
+	}
+	return registers, nil
+}
@@ -0,0 +1,209 @@
+package solarmon
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is what a HTTP client may do, RoleControl includes RoleRead.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleRead
+	RoleControl
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleRead:
+		return "read"
+	case RoleControl:
+		return "control"
+	}
+	return "none"
+}
+
+func parseRole(s string) (Role, error) {
+	switch s {
+	case "read":
+		return RoleRead, nil
+	case "control":
+		return RoleControl, nil
+	}
+	return RoleNone, fmt.Errorf("invalid role %q, want read or control", s)
+}
+
+type httpUser struct {
+	password string
+	role     Role
+}
+
+type httpToken struct {
+	token string
+	role  Role
+}
+
+// HTTPAuth checks the basic auth users and bearer tokens of the HTTP
+// listener. A nil or empty HTTPAuth lets everybody read and nobody
+// control, one with control credentials only still lets everybody read.
+type HTTPAuth struct {
+	users  map[string]httpUser
+	tokens []httpToken
+}
+
+// ParseHTTPAuth parses the -HTTPUsers (user:password:role) and -HTTPTokens
+// (token:role) lists, comma separated.
+func ParseHTTPAuth(users, tokens string) (*HTTPAuth, error) {
+	a := &HTTPAuth{users: make(map[string]httpUser)}
+	for _, entry := range splitList(users) {
+		f := strings.Split(entry, ":")
+		if len(f) != 3 || f[0] == "" || f[1] == "" {
+			return nil, fmt.Errorf("invalid -HTTPUsers entry, want user:password:role")
+		}
+		role, err := parseRole(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("-HTTPUsers %s: %v", f[0], err)
+		}
+		a.users[f[0]] = httpUser{password: f[1], role: role}
+	}
+
+	for _, entry := range splitList(tokens) {
+		i := strings.LastIndex(entry, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid -HTTPTokens entry, want token:role")
+		}
+		role, err := parseRole(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("-HTTPTokens: %v", err)
+		}
+		a.AddToken(entry[:i], role)
+	}
+	return a, nil
+}
+
+func splitList(s string) []string {
+	var entries []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// AddToken accepts token as bearer token with role.
+func (a *HTTPAuth) AddToken(token string, role Role) {
+	a.tokens = append(a.tokens, httpToken{token: token, role: role})
+}
+
+// Enabled reports whether any credentials are configured.
+func (a *HTTPAuth) Enabled() bool {
+	return a != nil && (len(a.users) > 0 || len(a.tokens) > 0)
+}
+
+// readOpen reports whether reading needs no credentials: none with the
+// read role are configured, e.g. only a -controlToken.
+func (a *HTTPAuth) readOpen() bool {
+	if !a.Enabled() {
+		return true
+	}
+	for _, u := range a.users {
+		if u.role == RoleRead {
+			return false
+		}
+	}
+	for _, t := range a.tokens {
+		if t.role == RoleRead {
+			return false
+		}
+	}
+	return true
+}
+
+// Grants reports whether some credentials have role.
+func (a *HTTPAuth) Grants(role Role) bool {
+	if !a.Enabled() {
+		return role <= RoleRead
+	}
+	for _, u := range a.users {
+		if u.role >= role {
+			return true
+		}
+	}
+	for _, t := range a.tokens {
+		if t.role >= role {
+			return true
+		}
+	}
+	return false
+}
+
+// Role returns the role of the credentials r carries, RoleNone for wrong
+// ones. Requests without credentials get RoleRead while reading is open,
+// RoleNone otherwise.
+func (a *HTTPAuth) Role(r *http.Request) Role {
+	if !a.Enabled() {
+		return RoleRead
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		u, found := a.users[user]
+		// compared for unknown users too, against an empty password
+		match := secretEqual(password, u.password)
+		if found && match {
+			return u.role
+		}
+		return RoleNone
+	}
+
+	if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		got := strings.TrimPrefix(bearer, "Bearer ")
+		role := RoleNone
+		for _, t := range a.tokens {
+			if secretEqual(got, t.token) && t.role > role {
+				role = t.role
+			}
+		}
+		return role
+	}
+
+	if a.readOpen() {
+		return RoleRead
+	}
+	return RoleNone
+}
+
+func hasCredentials(r *http.Request) bool {
+	_, _, basic := r.BasicAuth()
+	return basic || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// secretEqual compares the SHA-256 digests of got and want: equal lengths
+// for subtle.ConstantTimeCompare, which returns at once on a length
+// mismatch, so the time taken tells nothing about want.
+func secretEqual(got, want string) bool {
+	g, w := sha256.Sum256([]byte(got)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
+
+// Require serves h to clients having role, 401 asks for credentials and
+// 403 rejects the ones with a lower role.
+func (a *HTTPAuth) Require(role Role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := a.Role(r)
+		if got >= role {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if got == RoleNone || (a.Enabled() && !hasCredentials(r)) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="solarmon"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "forbidden, needs the "+role.String()+" role", http.StatusForbidden)
+	})
+}
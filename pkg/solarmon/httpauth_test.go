@@ -0,0 +1,43 @@
+package solarmon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPAuthRequire(t *testing.T) {
+	tests := []struct {
+		name          string
+		users, tokens string
+		header        string
+		read, control int
+	}{
+		{name: "no credentials", read: 200, control: 403},
+		{name: "control token only", tokens: "s3cret:control", read: 200, control: 401},
+		{name: "control token only, sent", tokens: "s3cret:control", header: "Bearer s3cret", read: 200, control: 200},
+		{name: "control token only, wrong", tokens: "s3cret:control", header: "Bearer s3cre", read: 401, control: 401},
+		{name: "read user", users: "viewer:pass:read", tokens: "s3cret:control", read: 401, control: 401},
+		{name: "read user, sent", users: "viewer:pass:read", header: "Basic dmlld2VyOnBhc3M=", read: 200, control: 403},
+		{name: "read user, unknown", users: "viewer:pass:read", header: "Basic b3RoZXI6cGFzcw==", read: 401, control: 401},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		auth, err := ParseHTTPAuth(tt.users, tt.tokens)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for role, want := range map[Role]int{RoleRead: tt.read, RoleControl: tt.control} {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			auth.Require(role, ok).ServeHTTP(w, req)
+			if w.Code != want {
+				t.Errorf("%s, %s: got %d, want %d", tt.name, role, w.Code, want)
+			}
+		}
+	}
+}
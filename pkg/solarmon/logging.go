@@ -0,0 +1,95 @@
+package solarmon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Components tagging the log records, see ComponentLogger.
+const (
+	LogBus      = "bus"
+	LogRegister = "register"
+	LogInflux   = "influx"
+	LogHTTP     = "http"
+	LogClock    = "clock"
+	LogPoller   = "poller"
+)
+
+// NewLogger builds the logger set with -logLevel and -logFormat writing to
+// w. The journal format leaves the time to journald and prefixes every
+// line with its syslog priority, e.g. <4> for warnings. Every format goes
+// through cfg.Secrets.
+func NewLogger(cfg *Config, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid -logLevel %q, want debug, info, warn or error", cfg.LogLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(cfg.LogFormat) {
+	case "text":
+		return slog.New(&redactHandler{slog.NewTextHandler(w, opts), cfg.Secrets}), nil
+	case "json":
+		return slog.New(&redactHandler{slog.NewJSONHandler(w, opts), cfg.Secrets}), nil
+	case "journal":
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		}
+		return slog.New(&redactHandler{&journalHandler{
+			Handler: slog.NewTextHandler(w, opts),
+			w:       w,
+			mutex:   &sync.Mutex{},
+		}, cfg.Secrets}), nil
+	}
+	return nil, fmt.Errorf("invalid -logFormat %q, want text, json or journal", cfg.LogFormat)
+}
+
+// ComponentLogger returns log tagged with component, the default logger
+// when log is nil.
+func ComponentLogger(log *slog.Logger, component string) *slog.Logger {
+	if log == nil {
+		log = slog.Default()
+	}
+	return log.With("component", component)
+}
+
+// journalHandler writes the sd-daemon priority prefix before each record.
+type journalHandler struct {
+	slog.Handler
+	w     io.Writer
+	mutex *sync.Mutex
+}
+
+func (h *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	priority := 7
+	switch {
+	case r.Level >= slog.LevelError:
+		priority = 3
+	case r.Level >= slog.LevelWarn:
+		priority = 4
+	case r.Level >= slog.LevelInfo:
+		priority = 6
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, err := fmt.Fprintf(h.w, "<%d>", priority); err != nil {
+		return err
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journalHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w, mutex: h.mutex}
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{Handler: h.Handler.WithGroup(name), w: h.w, mutex: h.mutex}
+}
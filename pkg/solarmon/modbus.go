@@ -10,12 +10,48 @@ import (
 	"github.com/goburrow/modbus"
 )
 
+// Transport reads raw holding registers from a device. ModbusRTU is the
+// default implementation, others can be injected through Options.
+type Transport interface {
+	Read(id uint16, cnt uint16) ([]byte, error)
+	Close()
+}
+
+// NewTransport returns the transport selected by cfg: a capture replay, a
+// Modbus TCP or the serial RTU one, recording to cfg.Capture if set.
+func NewTransport(cfg *Config) (Transport, error) {
+	var t Transport
+	var err error
+
+	switch {
+	case cfg.Replay != "":
+		return NewReplayTransport(cfg.Replay)
+	case cfg.ModbusTCP != "":
+		t, err = NewModbusTCP(cfg)
+	default:
+		t, err = NewModbusRTU(cfg)
+	}
+
+	if err != nil || cfg.Capture == "" {
+		return t, err
+	}
+	return NewRecordingTransport(t, cfg.Capture, cfg.SlaveID)
+}
+
 func NewModbusRTU(cfg *Config) (*ModbusRTU, error) {
 	portName := cfg.TTYFile
 	if runtime.GOOS == "windows" {
 		portName = "\\\\.\\" + cfg.TTYFile
 	}
 
+	if cfg.TTYSelect != "" {
+		tty, err := FindTTY(cfg.TTYSelect)
+		if err != nil {
+			return nil, err
+		}
+		portName = tty
+	}
+
 	handler := modbus.NewRTUClientHandler(portName)
 	handler.BaudRate = cfg.BaudRate
 	handler.DataBits = cfg.DataBits
@@ -25,35 +61,53 @@ func NewModbusRTU(cfg *Config) (*ModbusRTU, error) {
 	handler.Timeout = cfg.Timeout
 	handler.IdleTimeout = cfg.Timeout * 2
 
-	return &ModbusRTU{handler: handler, connected: false, autoTTY: cfg.AutoTTY}, nil
+	m := &ModbusRTU{handler: handler, connected: false, autoTTY: cfg.AutoTTY, ttySelect: cfg.TTYSelect}
+	m.supervisor = NewSupervisor(cfg, NewResetHook(cfg.USBReset, func() string { return m.handler.Address }))
+
+	return m, nil
 }
 
 type ModbusRTU struct {
-	handler   *modbus.RTUClientHandler
-	client    modbus.Client
-	autoTTY   bool
-	connected bool
+	handler    *modbus.RTUClientHandler
+	client     modbus.Client
+	autoTTY    bool
+	ttySelect  string
+	connected  bool
+	supervisor *Supervisor
 }
 
 func (m *ModbusRTU) Client() (modbus.Client, error) {
 	var err error
 	var addr string
 
+	if !m.connected {
+		if err = m.supervisor.Allow(); err != nil {
+			return nil, err
+		}
+	}
+
 	if runtime.GOOS == "linux" {
-		if _, err := os.Stat(m.handler.Address); err != nil {
+		_, statErr := os.Stat(m.handler.Address)
+		if statErr != nil {
 			m.connected = false
-			if m.autoTTY {
-				addr, err = getTTYUSBdevicePath()
-				if err != nil {
-					return nil, err
-				}
+		}
+
+		// A USB reset may give the selected adapter another ttyUSB number
+		// while the old one still exists, so -ttySelect is resolved again
+		// on every reconnect. -autotty only looks when the TTY is gone.
+		if (statErr != nil && m.autoTTY) || (!m.connected && m.ttySelect != "") {
+			addr, err = FindTTY(m.ttySelect)
+			if err != nil {
+				return nil, &BusError{Class: ErrClassPortMissing, Err: err}
+			}
+			if addr != m.handler.Address {
 				m.Close()
 				m.handler.Address = addr
 				m.client = nil
-			} else {
-				err = fmt.Errorf("TTYFile %s is missing(make sure rs485 to USB adapter is connected)", m.handler.Address)
-				return nil, err
 			}
+		} else if statErr != nil {
+			err = fmt.Errorf("TTYFile %s is missing(make sure rs485 to USB adapter is connected)", m.handler.Address)
+			return nil, &BusError{Class: ErrClassPortMissing, Err: err}
 		}
 	}
 
@@ -66,7 +120,7 @@ func (m *ModbusRTU) Client() (modbus.Client, error) {
 
 		m.connected = true
 		if err != nil {
-			err = fmt.Errorf("error while connecting to %s: %v", m.handler.Address, err)
+			err = fmt.Errorf("error while connecting to %s: %w", m.handler.Address, err)
 			m.connected = false
 		}
 	}
@@ -81,20 +135,73 @@ func (m *ModbusRTU) Read(id uint16, cnt uint16) ([]byte, error) {
 	c, err := m.Client()
 
 	if err != nil {
-		return nil, fmt.Errorf("unable to read hregister %v: %v", id, err)
+		return nil, m.failure(OpRead, id, err)
 	}
 
 	r, err = c.ReadHoldingRegisters(id, cnt)
 
 	if err != nil {
-		err = fmt.Errorf("unable to read hregister %v: %v", id, err)
-		m.connected = false
+		return r, m.failure(OpRead, id, err)
 	}
 
-	return r, err
+	m.supervisor.Success()
+	return r, nil
 	//return []byte{0x01, 0x00, 0x00, 0x00}, nil
 }
 
+// Write writes holding registers starting at id.
+func (m *ModbusRTU) Write(id uint16, data []byte) error {
+	c, err := m.Client()
+	if err != nil {
+		return m.failure(OpWrite, id, err)
+	}
+
+	if _, err := c.WriteMultipleRegisters(id, uint16(len(data)/2), data); err != nil {
+		return m.failure(OpWrite, id, err)
+	}
+
+	m.supervisor.Success()
+	return nil
+}
+
+// Upload sends a Huawei extended function 0x41 request.
+func (m *ModbusRTU) Upload(req []byte) ([]byte, error) {
+	if _, err := m.Client(); err != nil {
+		return nil, m.failure(OpUpload, 0, err)
+	}
+
+	resp, err := rtuUpload(m.handler, req)
+	if err != nil {
+		return nil, m.failure(OpUpload, 0, err)
+	}
+
+	m.supervisor.Success()
+	return resp, nil
+}
+
+// failure tells the supervisor about a failed request. An exception is an
+// answer, the link is fine, and a backoff refusal never reached the bus.
+func (m *ModbusRTU) failure(op BusOp, id uint16, err error) *BusError {
+	busErr := NewBusError(op, id, err)
+	switch {
+	case busErr.Class == ErrClassBackoff:
+	case busErr.TransportLevel():
+		m.connected = false
+		m.supervisor.Failure(busErr)
+	default:
+		m.supervisor.Success()
+	}
+	return busErr
+}
+
+func (m *ModbusRTU) Health() HealthStatus {
+	return m.supervisor.Health()
+}
+
+func (m *ModbusRTU) SetSlaveID(id byte) {
+	m.handler.SlaveId = id
+}
+
 func (m *ModbusRTU) Reconnect() error {
 	m.handler.Close()
 	return m.handler.Connect()
@@ -104,6 +211,110 @@ func (m *ModbusRTU) Close() {
 	m.handler.Close()
 }
 
+func NewModbusTCP(cfg *Config) (*ModbusTCP, error) {
+	handler := modbus.NewTCPClientHandler(cfg.ModbusTCP)
+	handler.SlaveId = byte(cfg.SlaveID)
+	handler.Timeout = cfg.Timeout
+	handler.IdleTimeout = cfg.Timeout * 2
+
+	return &ModbusTCP{
+		handler:    handler,
+		client:     modbus.NewClient(handler),
+		supervisor: NewSupervisor(cfg, nil),
+	}, nil
+}
+
+type ModbusTCP struct {
+	handler    *modbus.TCPClientHandler
+	client     modbus.Client
+	connected  bool
+	supervisor *Supervisor
+}
+
+func (m *ModbusTCP) connect(op BusOp, id uint16) error {
+	if m.connected {
+		return nil
+	}
+
+	if err := m.supervisor.Allow(); err != nil {
+		return NewBusError(op, id, err)
+	}
+
+	m.handler.Close()
+	if err := m.handler.Connect(); err != nil {
+		busErr := NewBusError(op, id, fmt.Errorf("error while connecting to %s: %w", m.handler.Address, err))
+		m.supervisor.Failure(busErr)
+		return busErr
+	}
+	m.connected = true
+	return nil
+}
+
+func (m *ModbusTCP) Read(id uint16, cnt uint16) ([]byte, error) {
+	if err := m.connect(OpRead, id); err != nil {
+		return nil, err
+	}
+
+	r, err := m.client.ReadHoldingRegisters(id, cnt)
+
+	if err != nil {
+		return r, m.failure(OpRead, id, err)
+	}
+
+	m.supervisor.Success()
+	return r, nil
+}
+
+// Write writes holding registers starting at id.
+func (m *ModbusTCP) Write(id uint16, data []byte) error {
+	if err := m.connect(OpWrite, id); err != nil {
+		return err
+	}
+
+	if _, err := m.client.WriteMultipleRegisters(id, uint16(len(data)/2), data); err != nil {
+		return m.failure(OpWrite, id, err)
+	}
+
+	m.supervisor.Success()
+	return nil
+}
+
+// Upload sends a Huawei extended function 0x41 request.
+func (m *ModbusTCP) Upload(req []byte) ([]byte, error) {
+	if err := m.connect(OpUpload, 0); err != nil {
+		return nil, err
+	}
+
+	resp, err := uploadPDU(m.handler, req)
+	if err != nil {
+		return nil, m.failure(OpUpload, 0, err)
+	}
+
+	m.supervisor.Success()
+	return resp, nil
+}
+
+// failure tells the supervisor about a failed request, see
+// ModbusRTU.failure.
+func (m *ModbusTCP) failure(op BusOp, id uint16, err error) *BusError {
+	busErr := NewBusError(op, id, err)
+	if busErr.TransportLevel() {
+		m.connected = false
+		m.supervisor.Failure(busErr)
+	} else {
+		m.supervisor.Success()
+	}
+	return busErr
+}
+
+func (m *ModbusTCP) Health() HealthStatus {
+	return m.supervisor.Health()
+}
+
+func (m *ModbusTCP) Close() {
+	m.handler.Close()
+}
+
 func getTTYUSBdevicePath() (string, error) {
 	files, err := ioutil.ReadDir("/dev/")
 	if err != nil {
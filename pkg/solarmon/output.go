@@ -2,9 +2,15 @@ package solarmon
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -15,48 +21,148 @@ import (
 const MaxInfluxQSize = 120
 const MaxPostsPerFlush = 12
 
+// MaxInfluxEvents caps the event points kept until the next post
+const MaxInfluxEvents = 500
+
+// Output receives the readings of every cycle and the operational events,
+// see events.go.
 type Output interface {
 	WriteRegisters([]*Register) error
-	Write(string) error
+	WriteEvent(Event) error
+}
+
+// OutputCloser is implemented by outputs holding a listener or pending
+// data. Close should flush what it can before ctx expires.
+type OutputCloser interface {
+	Close(ctx context.Context) error
 }
 
-func GetOutputs(cfg *Config) map[string]Output {
-	var defaultOut Output
+// GetOutputs builds the outputs of cfg, their diagnostics go to log.
+func GetOutputs(cfg *Config, log *slog.Logger) (map[string]Output, error) {
 	outputs := make(map[string]Output)
+	if err := buildOutputs(cfg, log, outputs); err != nil {
+		closeOutputs(outputs)
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// closeOutputs releases the listeners of outputs without posting their
+// queues, a queue file still gets what is pending.
+func closeOutputs(outputs map[string]Output) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, output := range outputs {
+		if closer, ok := output.(OutputCloser); ok {
+			closer.Close(ctx)
+		}
+	}
+}
+
+func buildOutputs(cfg *Config, log *slog.Logger, outputs map[string]Output) error {
 	if cfg.Once {
-		outputs["stdout"] = NewStdOutput()
-		defaultOut = outputs["stdout"]
+		stdOut := NewStdOutput()
+		stdOut.secrets = cfg.Secrets
+		outputs["stdout"] = stdOut
 	} else {
 		header := fmt.Sprintf(
 			"start=%s %s",
 			cfg.StartTime.Format("2006-01-02 15:04:05"),
 			cfg.Version,
 		)
-		outputs["http"] = NewHTTPOutput(cfg.HTTPListen, header)
-		defaultOut = outputs["http"]
+		if cfg.Profile != "" {
+			header += " profile=" + cfg.Profile
+		}
+		auth, err := ParseHTTPAuth(cfg.HTTPUsers, cfg.HTTPTokens)
+		if err != nil {
+			return err
+		}
+		if cfg.ControlToken != "" {
+			auth.AddToken(cfg.ControlToken, RoleControl)
+		}
+
+		tlsConfig, fingerprint, err := ServerTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+
+		httpLog := ComponentLogger(log, LogHTTP)
+		httpOut, err := NewHTTPOutput(cfg.HTTPListen, header, tlsConfig, auth, httpLog)
+		if err != nil {
+			return err
+		}
+		httpOut.secrets = cfg.Secrets
+		if tlsConfig != nil {
+			httpLog.Info("serving https", "sha256", fingerprint)
+		}
+		if !auth.Enabled() && cfg.HTTPListen != "" {
+			httpLog.Warn("the HTTP listener has no authentication, see -HTTPUsers and -HTTPTokens")
+		}
+		outputs["http"] = httpOut
 	}
 
 	if cfg.Influxdb != "" {
-		outputs["influx"] = NewInfluxOutput(
-			cfg.Influxdb, cfg.InfluxTags, cfg.InfluxDry, defaultOut,
+		influxOut := NewInfluxOutput(
+			cfg.Influxdb, cfg.InfluxTags, cfg.InfluxDry, ComponentLogger(log, LogInflux),
 		)
+		if cfg.Location != nil {
+			influxOut.loc = cfg.Location
+		}
+		tc, err := InfluxTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		influxOut.transport.TLSClientConfig = tc
+		influxOut.user, influxOut.password = cfg.InfluxUser, cfg.InfluxPassword
+		influxOut.secrets = cfg.Secrets
+		if err := influxOut.LoadQueue(cfg.InfluxQueueFile); err != nil {
+			influxOut.log.Error("unable to load the queue", "file", cfg.InfluxQueueFile, "err", err)
+		}
+		outputs["influx"] = influxOut
+	}
+
+	if cfg.ReportByException != "" {
+		for _, name := range strings.Split(cfg.ReportByException, ",") {
+			out, ok := outputs[name]
+			if !ok {
+				return fmt.Errorf("-reportByException: no %s output", name)
+			}
+			outputs[name] = NewDeadbandOutput(out, cfg.Heartbeat)
+		}
+	}
+
+	// after the deadband filter, so it sees the window summaries
+	windows, err := ParseDownsample(cfg.Downsample)
+	if err != nil {
+		return err
+	}
+	for name, window := range windows {
+		out, ok := outputs[name]
+		if !ok {
+			return fmt.Errorf("-downsample: no %s output", name)
+		}
+		if outputs[name], err = NewDownsampleOutput(out, window, cfg.Location); err != nil {
+			return fmt.Errorf("-downsample %s: %v", name, err)
+		}
 	}
+	return nil
+}
 
-	return outputs
+func WriteToAllOutputs(outputs map[string]Output, registers []*Register) {
+	for _, output := range outputs {
+		output.WriteRegisters(registers)
+	}
 }
 
-func WriteToAllOutputs(outputs map[string]Output, data interface{}) {
+func WriteEventToAllOutputs(outputs map[string]Output, e Event) {
 	for _, output := range outputs {
-		switch v := data.(type) {
-		case []*Register:
-			output.WriteRegisters(v)
-		case string:
-			output.Write(v)
-		}
+		output.WriteEvent(e)
 	}
 }
 
-type StdOutput struct{}
+type StdOutput struct {
+	secrets *Redactor
+}
 
 func NewStdOutput() *StdOutput {
 	o := &StdOutput{}
@@ -70,8 +176,8 @@ func (o *StdOutput) WriteRegisters(data []*Register) error {
 	return nil
 }
 
-func (o *StdOutput) Write(data string) error {
-	fmt.Printf("%s ## %s\n", time.Now().Format("2006-01-02 15:04:05"), data)
+func (o *StdOutput) WriteEvent(e Event) error {
+	fmt.Printf("%s ## %s\n", e.EventTime().Format("2006-01-02 15:04:05"), o.secrets.Redact(e.String()))
 	return nil
 }
 
@@ -82,16 +188,59 @@ type HTTPOutput struct {
 	mutex     *sync.Mutex
 	shortTxt  string
 	longTxt   string
+	mux       *http.ServeMux
+	server    *http.Server
+	tls       *tls.Config
+	auth      *HTTPAuth
+	secrets   *Redactor
+	log       *slog.Logger
 }
 
-func NewHTTPOutput(listen string, header string) *HTTPOutput {
-	o := &HTTPOutput{}
+// NewHTTPOutput serves the text preview on listen using its own ServeMux.
+// An empty listen address skips the listener, the handler is still
+// reachable through Handler. HTTPS is served with tlsConfig, the preview
+// needs the read role of auth. A nil log uses the default logger.
+func NewHTTPOutput(listen string, header string, tlsConfig *tls.Config, auth *HTTPAuth, log *slog.Logger) (*HTTPOutput, error) {
+	if log == nil {
+		log = slog.Default()
+	}
+	o := &HTTPOutput{tls: tlsConfig, auth: auth, log: log}
 	o.maxBufLen = 1 * 1024 * 1024
 	o.listen = listen
 	o.header = header
 	o.mutex = &sync.Mutex{}
-	o.start()
-	return o
+	o.mux = http.NewServeMux()
+	if err := o.start(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *HTTPOutput) Handler() http.Handler {
+	return o.mux
+}
+
+// Handle serves h on pattern next to the preview, e.g. the control API.
+func (o *HTTPOutput) Handle(pattern string, h http.Handler) {
+	o.mux.Handle(pattern, h)
+}
+
+// findHTTPOutput returns the HTTP output of outputs, looking through the
+// wrapping outputs, nil without one.
+func findHTTPOutput(outputs map[string]Output) *HTTPOutput {
+	for _, out := range outputs {
+		for out != nil {
+			if h, ok := out.(*HTTPOutput); ok {
+				return h
+			}
+			w, ok := out.(interface{ Unwrap() Output })
+			if !ok {
+				break
+			}
+			out = w.Unwrap()
+		}
+	}
+	return nil
 }
 
 func (o *HTTPOutput) WriteRegisters(data []*Register) error {
@@ -109,10 +258,13 @@ func (o *HTTPOutput) WriteRegisters(data []*Register) error {
 	return nil
 }
 
-func (o *HTTPOutput) Write(data string) error {
+// WriteEvent shows the events on the long page, the cycle, link and alarm
+// events on the short one too.
+func (o *HTTPOutput) WriteEvent(e Event) error {
 	var shortTxt string
-	longTxt := fmt.Sprintf("%s ## %s", time.Now().Format("2006-01-02 15:04:05"), data)
-	if strings.Contains(data, "**") {
+	longTxt := fmt.Sprintf("%s ## %s\n", e.EventTime().Format("2006-01-02 15:04:05"), e)
+	switch e.(type) {
+	case CycleCompleted, TransportError, AlarmRaised, AlarmCleared:
 		shortTxt = longTxt
 	}
 
@@ -121,6 +273,8 @@ func (o *HTTPOutput) Write(data string) error {
 }
 
 func (o *HTTPOutput) updateContents(bodyShort, bodyLong string) error {
+	bodyShort, bodyLong = o.secrets.Redact(bodyShort), o.secrets.Redact(bodyLong)
+
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 	if len(o.longTxt) > o.maxBufLen {
@@ -138,8 +292,8 @@ func (o *HTTPOutput) updateContents(bodyShort, bodyLong string) error {
 	return nil
 }
 
-func (o *HTTPOutput) start() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+func (o *HTTPOutput) start() error {
+	o.mux.Handle("/", o.auth.Require(RoleRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		o.mutex.Lock()
 		defer o.mutex.Unlock()
 		header := fmt.Sprintf("now=%s %s\n\n", time.Now().Format("2006-01-02 15:04:05"), o.header)
@@ -151,39 +305,79 @@ func (o *HTTPOutput) start() {
 		} else {
 			fmt.Fprintf(w, header+o.longTxt)
 		}
-	})
+	})))
 
-	go http.ListenAndServe(o.listen, nil)
+	if o.listen == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", o.listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", o.listen, err)
+	}
+	if o.tls != nil {
+		ln = tls.NewListener(ln, o.tls)
+	}
+
+	o.server = &http.Server{Handler: o.mux, ErrorLog: slog.NewLogLogger(o.log.Handler(), slog.LevelWarn)}
+	go func() {
+		if err := o.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			o.log.Error("server stopped", "addr", o.listen, "err", err)
+		}
+	}()
+	o.log.Info("listening", "addr", ln.Addr().String())
+	return nil
+}
+
+func (o *HTTPOutput) Close(ctx context.Context) error {
+	if o.server == nil {
+		return nil
+	}
+	return o.server.Shutdown(ctx)
 }
 
 type InfluxOutput struct {
-	out        Output
 	uri        string
+	user       string
+	password   string
 	globalTags string
 	q          [][]string
+	qFile      string
+	dropped    int
+	events     []string
+	loc        *time.Location
 	dryRun     bool
 	httpClient *http.Client
+	transport  *http.Transport
+	secrets    *Redactor
+	log        *slog.Logger
 }
 
-func NewInfluxOutput(uri string, globalTags string, dryRun bool, defaultOut Output) *InfluxOutput {
+// NewInfluxOutput posts to uri, or prints the queries on stdout with
+// dryRun. Errors go to log, the default logger when nil.
+func NewInfluxOutput(uri string, globalTags string, dryRun bool, log *slog.Logger) *InfluxOutput {
+	if log == nil {
+		log = slog.Default()
+	}
 	o := &InfluxOutput{
+		log:        log,
 		uri:        uri,
 		globalTags: globalTags,
 		dryRun:     dryRun,
-		out:        defaultOut,
 		q:          make([][]string, 0, 30),
+		loc:        time.Local,
 	}
 
-	transport := &http.Transport{
+	o.transport = &http.Transport{
 		MaxIdleConns:        5,
 		IdleConnTimeout:     30 * time.Second,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
 		TLSHandshakeTimeout: 15 * time.Second,
 	}
 
 	o.httpClient = &http.Client{
 		Timeout:   15 * time.Second,
-		Transport: transport,
+		Transport: o.transport,
 	}
 
 	return o
@@ -193,13 +387,21 @@ func (o *InfluxOutput) WriteRegisters(data []*Register) error {
 	queries := o.prepareQueries(data)
 
 	if len(queries) == 0 {
-		o.out.Write("ERR Influxdb: no queries to exec\n")
-		return nil
+		o.log.Warn("no queries to exec")
+		if len(o.events) == 0 {
+			return nil
+		}
+	}
+
+	if len(o.events) > 0 {
+		queries = append(queries, strings.Join(o.events, ""))
+		o.events = nil
 	}
 
 	if len(o.q) >= MaxInfluxQSize {
-		o.out.Write(fmt.Sprintf("ERR Influxdb: max qsize[%d]\n", MaxInfluxQSize))
+		o.log.Warn("queue full, dropping the oldest request", "qsize", MaxInfluxQSize)
 		o.q = o.q[1:]
+		o.dropped++
 	}
 
 	o.q = append(o.q, queries)
@@ -207,10 +409,9 @@ func (o *InfluxOutput) WriteRegisters(data []*Register) error {
 	startQSize := len(o.q)
 	okReqs := 0
 	for tries := 1; len(o.q) > 0 && tries <= MaxPostsPerFlush; tries++ {
-		err := o.executeQueries(o.q[0])
+		err := o.executeQueries(context.Background(), o.q[0])
 		if err != nil {
-			errTxt := strings.Replace(err.Error(), o.uri, "http://endpoint", 1)
-			o.out.Write(fmt.Sprintf("ERR Influxdb query: qsize=%d req=%d %s\n", len(o.q), tries, errTxt))
+			o.log.Error("query failed", "qsize", len(o.q), "req", tries, "err", err)
 			break
 		} else {
 			o.q = o.q[1:]
@@ -219,17 +420,154 @@ func (o *InfluxOutput) WriteRegisters(data []*Register) error {
 	}
 
 	if startQSize > 1 && okReqs > 0 {
-		o.out.Write(fmt.Sprintf("OK Influxdb query: qsize=%d finished_reqs=%d\n", len(o.q), okReqs))
+		o.log.Info("queue flushed", "qsize", len(o.q), "finished_reqs", okReqs)
 	}
 	return nil
 }
 
-func (o *InfluxOutput) Write(data string) error {
+// WriteEvent keeps the event as a point posted with the next readings.
+func (o *InfluxOutput) WriteEvent(e Event) error {
+	line := o.eventLine(e)
+	if line == "" {
+		return nil
+	}
+	if len(o.events) >= MaxInfluxEvents {
+		o.events = o.events[1:]
+	}
+	o.events = append(o.events, line)
 	return nil
 }
 
+// eventLine turns e into line protocol points, empty for unknown events.
+// A cycle brings its bus_errors point along.
+func (o *InfluxOutput) eventLine(e Event) string {
+	var measurement, fields string
+	switch v := e.(type) {
+	case CycleCompleted:
+		measurement = "cycle"
+		fields = fmt.Sprintf(
+			"read=%g,write=%g,failed=%di,registers=%di,held=%t",
+			v.Read.Seconds(), v.Write.Seconds(), v.Failed, v.Registers, v.Held,
+		)
+	case NightModeEntered:
+		measurement, fields = "nightmode", "active=true"
+	case NightModeExited:
+		measurement, fields = "nightmode", "active=false"
+	case TransportError:
+		measurement = "bus_state"
+		fields = fmt.Sprintf("state=%s,failures=%di", influxString(string(v.State)), v.Failures)
+		if v.Err != nil {
+			fields += ",err=" + influxString(v.Err.Error())
+		}
+	case QueueBacklog:
+		measurement = "queue,output=" + v.Output
+		fields = fmt.Sprintf("pending=%di,max=%di,dropped=%di", v.Pending, v.Max, v.Dropped)
+	case AlarmRaised:
+		measurement = "alarm,register=" + strings.Trim(v.Register, "* ")
+		fields = fmt.Sprintf("bit=%di,label=%s,active=true", v.Bit, influxString(v.Label))
+	case AlarmCleared:
+		measurement = "alarm,register=" + strings.Trim(v.Register, "* ")
+		fields = fmt.Sprintf("bit=%di,label=%s,active=false", v.Bit, influxString(v.Label))
+	default:
+		return ""
+	}
+
+	parts := strings.SplitN(measurement, ",", 2)
+	header := parts[0] + "," + o.globalTags
+	if len(parts) == 2 {
+		header += "," + parts[1]
+	}
+	line := fmt.Sprintf("%s %s %d\n", header, fields, e.EventTime().UnixNano())
+	if c, ok := e.(CycleCompleted); ok {
+		line += o.busErrorsLine(c)
+	}
+	return line
+}
+
+// Backlog returns the requests waiting to be posted.
+func (o *InfluxOutput) Backlog() Backlog {
+	return Backlog{Pending: len(o.q), Max: MaxInfluxQSize, Dropped: o.dropped}
+}
+
+// LoadQueue restores the queries persisted by a previous Close and makes
+// Close persist whatever is still pending to the same file.
+func (o *InfluxOutput) LoadQueue(file string) error {
+	o.qFile = file
+	if file == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var q [][]string
+	if err := json.Unmarshal(content, &q); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", file, err)
+	}
+
+	if len(q) > MaxInfluxQSize {
+		q = q[len(q)-MaxInfluxQSize:]
+	}
+	o.q = append(q, o.q...)
+	return nil
+}
+
+// Close tries to flush the queue until ctx expires and persists the rest.
+func (o *InfluxOutput) Close(ctx context.Context) error {
+	if len(o.events) > 0 {
+		o.q = append(o.q, []string{strings.Join(o.events, "")})
+		o.events = nil
+	}
+
+	var err error
+	for len(o.q) > 0 && ctx.Err() == nil {
+		if err = o.executeQueries(ctx, o.q[0]); err != nil {
+			break
+		}
+		o.q = o.q[1:]
+	}
+
+	if o.qFile == "" {
+		if len(o.q) > 0 {
+			return fmt.Errorf("dropped %d pending influx requests", len(o.q))
+		}
+		return nil
+	}
+
+	if len(o.q) == 0 {
+		if err := os.Remove(o.qFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	content, err := json.Marshal(o.q)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(o.qFile, content, 0600)
+}
+
 func (o *InfluxOutput) prepareQueries(registers []*Register) []string {
 	measurements := make(map[string]map[string][]string)
+	now := cycleTime(registers)
+
+	values := make(map[string]float64)
+	for _, register := range registers {
+		if v, ok := register.numeric(); ok {
+			values[strings.Trim(register.name, "* ")] = v
+		}
+	}
+	value := func(name string) (float64, bool) {
+		v, ok := values[strings.Trim(name, "* ")]
+		return v, ok
+	}
+
 	for _, register := range registers {
 		//cpu_load_short,host=server01,region=us-west value=0.64,val2=111 1434055562000000000
 
@@ -237,9 +575,6 @@ func (o *InfluxOutput) prepareQueries(registers []*Register) []string {
 			measurements[register.MName] = make(map[string][]string)
 		}
 
-		loc, _ := time.LoadLocation("UTC")
-		ts := time.Now().In(loc)
-
 		register.Mutex.Lock()
 
 		if register.TsType == "none" || register.lastErr != nil {
@@ -247,34 +582,30 @@ func (o *InfluxOutput) prepareQueries(registers []*Register) []string {
 			continue
 		}
 
-		switch register.TsType {
-		case "5m":
-			min := ts.Minute() - (ts.Minute() % 5)
-			ts = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), min, 0, 0, time.UTC)
-		case "-1h":
-			ts = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour()-1, 0, 0, 0, time.UTC)
-		case "1h":
-			ts = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), 0, 0, 0, time.UTC)
-		case "-1d":
-			ts = time.Date(ts.Year(), ts.Month(), ts.Day()-1, 5, 0, 0, 0, time.UTC)
-		case "1d":
-			ts = time.Date(ts.Year(), ts.Month(), ts.Day(), 5, 0, 0, 0, time.UTC)
-		case "1m":
-			ts = time.Date(ts.Year(), ts.Month(), 1, 5, 0, 0, 0, time.UTC)
-		case "-1m":
-			ts = time.Date(ts.Year(), time.Month(int(ts.Month())-1), 1, 5, 0, 0, 0, time.UTC)
-		case "1y":
-			ts = time.Date(ts.Year(), time.Month(1), 1, 5, 0, 0, 0, time.UTC)
-		case "-1y":
-			ts = time.Date(ts.Year()-1, time.Month(1), 1, 5, 0, 0, 0, time.UTC)
-		case "inf":
-			ts = time.Unix(0, 0)
+		ts := register.ts
+		if ts.IsZero() {
+			align := register.align
+			if align == nil {
+				align, _ = ParseAlignment(register.TsType)
+			}
+			if align == nil {
+				align = &Alignment{}
+			}
+
+			var ok bool
+			if ts, ok = align.Time(now, o.loc, value); !ok {
+				register.Mutex.Unlock()
+				continue
+			}
 		}
 
 		fieldName := strings.Trim(register.name, "* ")
 		fieldName = strings.Split(fieldName, "^")[0]
 
 		registerValue := fmt.Sprintf("%s=%s", fieldName, register.value)
+		if register.codes != nil {
+			registerValue += fmt.Sprintf(",%s_label=%s", fieldName, influxString(register.label))
+		}
 		tsvalue := fmt.Sprintf("%v", ts.UnixNano())
 
 		measurements[register.MName][tsvalue] = append(
@@ -302,20 +633,70 @@ func (o *InfluxOutput) prepareQueries(registers []*Register) []string {
 	return queries
 }
 
-func (o *InfluxOutput) executeQueries(queries []string) error {
+// influxString quotes a line protocol string field value
+func influxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// countErrors counts the failed registers per error class and the
+// disabled ones. Derived registers are left out, they fail with their
+// inputs or on their formula, not on the bus.
+func countErrors(registers []*Register) (map[ErrClass]int, int) {
+	counts := make(map[ErrClass]int)
+	disabled := 0
+	for _, register := range registers {
+		if register.Derived() {
+			continue
+		}
+		reading := register.Reading()
+		if reading.Disabled {
+			disabled++
+			continue
+		}
+		if reading.Err != nil {
+			counts[reading.ErrClass]++
+		}
+	}
+	return counts, disabled
+}
+
+// busErrorsLine is the bus_errors point of the cycle, posted with its
+// cycle point.
+func (o *InfluxOutput) busErrorsLine(e CycleCompleted) string {
+	values := []string{fmt.Sprintf("disabled=%di", e.Disabled)}
+	for _, class := range ErrClasses {
+		values = append(values, fmt.Sprintf("err_%s=%di", class, e.Errors[class]))
+	}
+
+	return fmt.Sprintf("bus_errors,%s %s %v\n", o.globalTags, strings.Join(values, ","), e.At.UnixNano())
+}
+
+func (o *InfluxOutput) executeQueries(ctx context.Context, queries []string) error {
 	body := []byte(strings.Join(queries, ""))
 
 	if o.dryRun {
-		o.out.Write("\ncurl '" + o.uri + "' --data-binary '" + string(body) + "'\n")
+		auth := ""
+		if o.user != "" || o.password != "" {
+			// as a whole, short passwords pass Redact
+			password := o.password
+			if password != "" {
+				password = "REDACTED"
+			}
+			auth = fmt.Sprintf(" -u '%s:%s'", o.user, password)
+		}
+		fmt.Print(o.secrets.Redact(fmt.Sprintf("\ncurl '%s'%s --data-binary '%s'\n\n", o.uri, auth, body)))
 		return nil
 	}
 
-	req, err := http.NewRequest("POST", o.uri, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", o.uri, bytes.NewBuffer(body))
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.user != "" || o.password != "" {
+		req.SetBasicAuth(o.user, o.password)
+	}
 
 	// Send request
 	resp, err := o.httpClient.Do(req)
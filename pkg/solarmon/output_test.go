@@ -0,0 +1,33 @@
+package solarmon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfluxOutputNothingToPost(t *testing.T) {
+	var bodies []string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	o := NewInfluxOutput(influx.URL+"/write?db=test", "loc=1", false, nil)
+	if err := o.WriteRegisters(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 0 || len(o.q) != 0 {
+		t.Errorf("without readings or events: got %q posted and %d queued, want nothing", bodies, len(o.q))
+	}
+
+	o.WriteEvent(NightModeEntered{At: time.Unix(1, 0)})
+	o.WriteRegisters(nil)
+	if len(bodies) != 1 || bodies[0] != "nightmode,loc=1 active=true 1000000000\n" {
+		t.Errorf("with an event: got %q, want the event point", bodies)
+	}
+}
@@ -0,0 +1,74 @@
+package solarmon
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period is a calendar period in the site timezone. Starts are computed
+// on the local calendar, so days are 23 or 25 hours long around DST
+// changes and months have their real length.
+type Period string
+
+const (
+	PeriodHour  Period = "hour"
+	PeriodDay   Period = "day"
+	PeriodWeek  Period = "week"
+	PeriodMonth Period = "month"
+	PeriodYear  Period = "year"
+)
+
+// ParsePeriod accepts the rfile shorthands h, d, w, m, y and the full names.
+func ParsePeriod(s string) (Period, error) {
+	switch s {
+	case "h", "hour":
+		return PeriodHour, nil
+	case "d", "day":
+		return PeriodDay, nil
+	case "w", "week":
+		return PeriodWeek, nil
+	case "m", "month":
+		return PeriodMonth, nil
+	case "y", "year":
+		return PeriodYear, nil
+	}
+	return "", fmt.Errorf("unknown period %q", s)
+}
+
+// Start returns the start of the period holding t.
+func (p Period) Start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch p {
+	case PeriodHour:
+		// Not time.Date, the local hour is ambiguous when the clock goes back
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case PeriodDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	case PeriodWeek:
+		// weeks start on Monday
+		return time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	case PeriodMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	case PeriodYear:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, loc)
+	}
+	return t
+}
+
+// Next returns the start of the period after the one starting at start.
+func (p Period) Next(start time.Time, loc *time.Location) time.Time {
+	start = start.In(loc)
+	switch p {
+	case PeriodHour:
+		return start.Add(time.Hour)
+	case PeriodDay:
+		return time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, loc)
+	case PeriodWeek:
+		return time.Date(start.Year(), start.Month(), start.Day()+7, 0, 0, 0, 0, loc)
+	case PeriodMonth:
+		return time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, loc)
+	case PeriodYear:
+		return time.Date(start.Year()+1, time.January, 1, 0, 0, 0, 0, loc)
+	}
+	return start
+}
@@ -0,0 +1,481 @@
+package solarmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options describe a Poller. Only Config is required, everything left nil
+// is built from it the same way the go-mbpool command does. A nil Logger
+// uses the default logger.
+type Options struct {
+	Config    *Config
+	Registers []*Register
+	Transport Transport
+	Outputs   map[string]Output
+	Logger    *slog.Logger
+}
+
+// Poller reads the configured registers on every interval and hands the
+// results to the outputs.
+type Poller struct {
+	cfg       *Config
+	registers []*Register
+	derived   []*Register
+	energy    *EnergyAggregator
+	clock     *Clock
+	history   *History
+	backfill  *Backfill
+	alarms    *alarmState
+	backlog   map[string]Backlog
+	transport Transport
+	outputs   map[string]Output
+	mutex     *sync.Mutex
+	lastErr   error
+	health    HealthState
+	paused    atomic.Bool
+	nmode     atomic.Bool
+	wake      chan struct{}
+	log       *slog.Logger
+	busLog    *slog.Logger
+	regLog    *slog.Logger
+	clockLog  *slog.Logger
+	httpLog   *slog.Logger
+}
+
+func NewPoller(opts Options) (_ *Poller, err error) {
+	if opts.Config == nil {
+		return nil, errors.New("poller config is missing")
+	}
+
+	p := &Poller{
+		cfg:       opts.Config,
+		registers: opts.Registers,
+		transport: opts.Transport,
+		outputs:   opts.Outputs,
+		mutex:     &sync.Mutex{},
+		backlog:   make(map[string]Backlog),
+		wake:      make(chan struct{}, 1),
+		log:       ComponentLogger(opts.Logger, LogPoller),
+		busLog:    ComponentLogger(opts.Logger, LogBus),
+		regLog:    ComponentLogger(opts.Logger, LogRegister),
+		clockLog:  ComponentLogger(opts.Logger, LogClock),
+		httpLog:   ComponentLogger(opts.Logger, LogHTTP),
+	}
+
+	for _, name := range p.cfg.Secrets.Short() {
+		p.log.Warn("secret shorter than 4 characters, not redacted in logs and pages", "secret", name)
+	}
+
+	// release what was opened here when a later step fails, the caller
+	// keeps the transport and outputs it passed in
+	defer func() {
+		if err == nil {
+			return
+		}
+		if opts.Transport == nil && p.transport != nil {
+			p.transport.Close()
+		}
+		if opts.Outputs == nil {
+			closeOutputs(p.outputs)
+		}
+	}()
+
+	var device *SunSpecDevice
+	if p.registers == nil && p.cfg.SunSpec {
+		// discovery needs the bus before the registers are known
+		if p.transport == nil {
+			p.transport, err = NewTransport(p.cfg)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		p.registers, device, err = DiscoverSunSpec(p.transport, p.cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ident *DeviceIdent
+	if p.registers == nil && p.cfg.Profile == ProfileAuto {
+		if p.transport == nil {
+			p.transport, err = NewTransport(p.cfg)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ident, err = DetectProfile(p.transport)
+		if err != nil {
+			return nil, err
+		}
+
+		p.cfg.Profile = strings.Join(ident.Profiles, ",")
+		var lines []string
+		lines, err = ProfileLines(p.cfg.Profile)
+		if err != nil {
+			return nil, err
+		}
+		p.cfg.ReadRegistersFromCli = append(lines, p.cfg.ReadRegistersFromCli...)
+	}
+
+	if p.registers == nil {
+		p.registers, err = GetRegistersToRead(p.cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p.registers) < 1 {
+		return nil, errors.New("please specify some registers")
+	}
+
+	p.derived, err = DerivedOrder(p.registers)
+	if err != nil {
+		return nil, err
+	}
+
+	p.energy = NewEnergyAggregator(p.registers, p.cfg.Location)
+	p.backfill = NewBackfill(p.registers, p.cfg)
+	p.alarms = newAlarmState(p.registers)
+
+	p.clock, err = NewClock(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.history, err = NewHistory(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.transport == nil {
+		p.transport, err = NewTransport(p.cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.outputs == nil {
+		p.outputs, err = GetOutputs(p.cfg, opts.Logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.nmode.Store(p.cfg.NMode)
+	if httpOut := findHTTPOutput(p.outputs); httpOut != nil && httpOut.auth.Grants(RoleControl) {
+		httpOut.Handle("/api/", p.ControlHandler(httpOut.auth))
+	} else if p.cfg.ControlToken != "" {
+		return nil, errors.New("-controlToken needs the HTTP listener, it is not started with -once")
+	}
+
+	if device != nil {
+		p.busLog.Info("SunSpec device discovered", "device", device.String(), "registers", len(p.registers))
+	}
+	if ident != nil {
+		p.busLog.Info("device detected", "device", ident.String(), "profile", p.cfg.Profile)
+	}
+
+	return p, nil
+}
+
+// Run polls until ctx is cancelled, or after the first cycle when
+// Config.Once is set. A cancelled ctx lets the bus transaction in flight
+// finish. The returned error is the result of the last completed cycle.
+func (p *Poller) Run(ctx context.Context) error {
+	night := false
+	for {
+		if ctx.Err() != nil {
+			return p.LastErr()
+		}
+
+		if p.paused.Load() {
+			p.sleep(ctx, p.cfg.ReadInterval)
+			continue
+		}
+
+		t0 := time.Now()
+		if night != p.nightMode(t0) {
+			night = !night
+			p.log.Info("night mode", "active", night, "from", p.cfg.NModeStart, "to", p.cfg.NModeEnd)
+			var e Event = NightModeExited{At: t0}
+			if night {
+				e = NightModeEntered{At: t0, Start: p.cfg.NModeStart, End: p.cfg.NModeEnd}
+			}
+			// the outputs are not safe for concurrent use, /api/poll may
+			// be running a cycle
+			p.mutex.Lock()
+			WriteEventToAllOutputs(p.outputs, e)
+			p.mutex.Unlock()
+		}
+
+		// No need of empty values during the night
+		if night {
+			p.sleep(ctx, p.cfg.NModeSleepInterval)
+			continue
+		}
+
+		p.Poll(ctx)
+
+		if p.cfg.Once || p.exhausted() {
+			return p.LastErr()
+		}
+
+		p.sleep(ctx, p.cfg.ReadInterval)
+	}
+}
+
+// Poll runs a single read cycle and writes the results to all outputs.
+// When ctx is cancelled in the middle of the cycle the remaining registers
+// are skipped, nothing is written and the previous cycle result is kept.
+func (p *Poller) Poll(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	failed := 0
+	t0 := time.Now()
+	for _, r := range p.registers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := r.ReadHR(p.transport); err != nil {
+			failed++
+			p.regLog.Debug("read failed", "register", r.name, "addr", r.id, "err", err)
+			// only the read disabling it fails, later ones are skipped
+			if r.Reading().Disabled {
+				p.regLog.Warn("register disabled after illegal address exceptions", "register", r.name, "addr", r.id)
+			}
+		}
+	}
+
+	EvalDerived(p.registers, p.derived)
+	now := transportNow(p.transport)
+
+	var extra []*Register
+	if p.clock != nil {
+		drift, note, err := p.clock.Check(p.transport)
+		if err != nil && drift == nil {
+			p.clockLog.Error("clock check failed", "err", err)
+		} else if err != nil {
+			p.clockLog.Error("clock set failed", "err", err)
+		}
+		if note != "" {
+			p.clockLog.Info(note)
+		}
+		if drift != nil {
+			extra = append(extra, drift)
+		}
+	}
+
+	hold := p.clock != nil && p.cfg.ClockHold && !p.clock.Synced()
+
+	if p.energy != nil && !hold {
+		extra = append(extra, p.energy.Update(now)...)
+	}
+
+	// backfill what the device kept while the bus was down
+	if p.backfill != nil && !hold {
+		points, notes := p.backfill.Update(now)
+		for _, note := range notes {
+			p.regLog.Warn(note)
+		}
+		extra = append(extra, points...)
+	}
+
+	recovered := failed == 0 && p.lastErr != nil
+	if p.history != nil && !hold && p.history.Due(now, recovered) {
+		records, err := p.history.Fetch(p.transport, now)
+		if err != nil {
+			p.busLog.Error("history upload failed", "err", err)
+		}
+		extra = append(extra, records...)
+	}
+
+	written := p.registers
+	if len(extra) > 0 {
+		written = append(append([]*Register{}, p.registers...), extra...)
+	}
+
+	t1 := time.Now()
+	if hold {
+		p.clockLog.Warn("host clock not synced yet, readings not written")
+	} else {
+		WriteToAllOutputs(p.outputs, written)
+	}
+	t2 := time.Now()
+
+	if p.alarms != nil {
+		for _, e := range p.alarms.Update(now) {
+			switch v := e.(type) {
+			case AlarmRaised:
+				p.regLog.Warn("alarm raised", "register", v.Register, "alarm", v.Label)
+			case AlarmCleared:
+				p.regLog.Info("alarm cleared", "register", v.Register, "alarm", v.Label)
+			}
+			WriteEventToAllOutputs(p.outputs, e)
+		}
+	}
+
+	errs, disabled := countErrors(p.registers)
+	WriteEventToAllOutputs(p.outputs, CycleCompleted{
+		At:        now,
+		Read:      t1.Sub(t0),
+		Write:     t2.Sub(t1),
+		Failed:    failed,
+		Registers: len(p.registers),
+		Held:      hold,
+		Errors:    errs,
+		Disabled:  disabled,
+	})
+	p.log.Debug("cycle done", "read", t1.Sub(t0), "write", t2.Sub(t1), "failed", failed, "registers", len(p.registers))
+
+	p.reportHealth()
+	p.reportBacklog()
+
+	p.lastErr = nil
+	if failed > 0 {
+		p.lastErr = fmt.Errorf("%d of %d registers failed", failed, len(p.registers))
+	}
+	return p.lastErr
+}
+
+// reportHealth tells the outputs when the transport link changed state.
+func (p *Poller) reportHealth() {
+	reporter, ok := p.transport.(HealthReporter)
+	if !ok {
+		return
+	}
+
+	h := reporter.Health()
+	if h.State == p.health || (p.health == "" && h.State == HealthHealthy) {
+		p.health = h.State
+		return
+	}
+	p.health = h.State
+
+	WriteEventToAllOutputs(p.outputs, TransportError{
+		At:          time.Now(),
+		State:       h.State,
+		Failures:    h.Failures,
+		NextAttempt: h.NextAttempt,
+		Err:         h.LastErr,
+	})
+
+	if h.State == HealthHealthy {
+		p.busLog.Info("link healthy")
+		return
+	}
+	p.busLog.Warn(
+		"link "+string(h.State),
+		"failures", h.Failures, "next_attempt", h.NextAttempt.Format("15:04:05"), "err", h.LastErr,
+	)
+}
+
+// reportBacklog tells the outputs when the queue of an output changed.
+func (p *Poller) reportBacklog() {
+	for name, output := range p.outputs {
+		reporter, ok := output.(BacklogReporter)
+		if !ok {
+			continue
+		}
+
+		b, prev := reporter.Backlog(), p.backlog[name]
+		if b.Pending == prev.Pending && b.Dropped == prev.Dropped {
+			continue
+		}
+		p.backlog[name] = b
+		WriteEventToAllOutputs(p.outputs, QueueBacklog{At: time.Now(), Output: name, Backlog: b})
+	}
+}
+
+// Health returns the transport link state, healthy when the transport does
+// not supervise its link.
+func (p *Poller) Health() HealthStatus {
+	if reporter, ok := p.transport.(HealthReporter); ok {
+		return reporter.Health()
+	}
+	return HealthStatus{State: HealthHealthy}
+}
+
+// LastErr is the result of the last completed cycle.
+func (p *Poller) LastErr() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.lastErr
+}
+
+// Snapshot returns the last reading of every register.
+func (p *Poller) Snapshot() []Reading {
+	readings := make([]Reading, 0, len(p.registers))
+	for _, r := range p.registers {
+		readings = append(readings, r.Reading())
+	}
+	return readings
+}
+
+// Shutdown flushes and closes the outputs, giving up on pending work when
+// ctx expires, then closes the transport. Run must have returned already.
+func (p *Poller) Shutdown(ctx context.Context) error {
+	var errs []string
+	for name, output := range p.outputs {
+		closer, ok := output.(OutputCloser)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	p.transport.Close()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("shutdown: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *Poller) nightMode(t time.Time) bool {
+	if _, ok := p.transport.(FiniteTransport); ok {
+		return false
+	}
+	// the hours are the site wall clock, not the host one
+	if p.cfg.Location != nil {
+		t = t.In(p.cfg.Location)
+	}
+	return p.nmode.Load() && !p.cfg.Once && (t.Hour() >= p.cfg.NModeStart || t.Hour() <= p.cfg.NModeEnd)
+}
+
+func (p *Poller) exhausted() bool {
+	f, ok := p.transport.(FiniteTransport)
+	return ok && f.Exhausted()
+}
+
+// wakeUp ends the sleep of Run, so pause, resume and night mode changes
+// apply right away.
+func (p *Poller) wakeUp() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sleep waits for d, until ctx is cancelled or wakeUp is called.
+func (p *Poller) sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-p.wake:
+	case <-t.C:
+	}
+}
@@ -0,0 +1,30 @@
+package solarmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNightModeSiteHours(t *testing.T) {
+	cfg := simConfig(t, "-tz", "Europe/Berlin", "-nightmodeStart", "22", "-nightmodeEnd", "5")
+	p := &Poller{cfg: cfg}
+	p.nmode.Store(true)
+
+	tests := []struct {
+		utc  int
+		want bool
+	}{
+		// 22:30 and 00:30 at the site in summer
+		{20, true},
+		{22, true},
+		// 21:30 and 06:30 at the site
+		{19, false},
+		{4, false},
+	}
+	for _, tt := range tests {
+		at := time.Date(2024, time.June, 15, tt.utc, 30, 0, 0, time.UTC)
+		if got := p.nightMode(at); got != tt.want {
+			t.Errorf("%s: got %v, want %v", at.Format("15:04 MST"), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package solarmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Profile is a built-in rfile for a device family. Models are patterns
+// (path.Match) for the model name the inverter reports in 30000.
+type Profile struct {
+	Name        string
+	Description string
+	Models      []string
+	Rfile       string
+}
+
+// ProfileAuto as -profile picks the profiles matching the device.
+const ProfileAuto = "auto"
+
+// Profiles are tried in order by the detection, the first model match wins.
+var Profiles = []*Profile{
+	{
+		Name:        "sun2000-ktl-a",
+		Description: "SUN2000 KTL-A, e.g. SUN2000-33KTL-A (legacy interface)",
+		Models:      []string{"SUN2000-*KTL-A"},
+		Rfile:       profileSun2000KTLA,
+	},
+	{
+		Name:        "sun2000-ktl-m0",
+		Description: "SUN2000 KTL-M0, e.g. SUN2000-20KTL-M0",
+		Models:      []string{"SUN2000-*KTL-M0"},
+		Rfile:       profileSun2000KTLM0,
+	},
+	{
+		Name:        "sun2000-ktl-m3",
+		Description: "SUN2000 KTL-M series, e.g. SUN2000-30KTL-M3 (the default registers)",
+		Models:      []string{"SUN2000-*KTL-M*", "SUN2000-*"},
+		Rfile:       defaultRfile + profileSun2000KTLM3,
+	},
+	{
+		Name:        "sun2000-meter",
+		Description: "DTSU666-H / DDSU666-H power meter connected to a SUN2000",
+		Rfile:       profileSun2000Meter,
+	},
+}
+
+// FindProfile returns the profile called name.
+func FindProfile(name string) (*Profile, error) {
+	for _, p := range Profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown profile %q, see -profile list", name)
+}
+
+// ProfileLines returns the rfile lines of comma separated profile names.
+func ProfileLines(names string) ([]string, error) {
+	var lines []string
+	for _, name := range strings.Split(names, ",") {
+		p, err := FindProfile(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.Split(p.Rfile, "\n")...)
+	}
+	return lines, nil
+}
+
+// DeviceIdent is what the identification registers of a device tell.
+type DeviceIdent struct {
+	Model    string
+	Serial   string
+	Meter    bool
+	Profiles []string
+}
+
+func (d *DeviceIdent) String() string {
+	return fmt.Sprintf("model=%s sn=%s profile=%s", d.Model, d.Serial, strings.Join(d.Profiles, ","))
+}
+
+// DetectProfile reads the model name (30000) and serial (30015) of a
+// SUN2000 and picks the matching profile. Inverters of the legacy interface
+// only answer with their ESN in 32003. A meter reporting a normal status in
+// 37100 adds the meter profile.
+func DetectProfile(t Transport) (*DeviceIdent, error) {
+	ident := &DeviceIdent{}
+
+	if raw, err := t.Read(30000, 15); err == nil {
+		ident.Model = identString(raw)
+		if raw, err := t.Read(30015, 10); err == nil {
+			ident.Serial = identString(raw)
+		}
+	} else if raw, err := t.Read(32003, 10); err == nil {
+		ident.Model = "SUN2000-KTL-A"
+		ident.Serial = identString(raw)
+	} else {
+		return nil, fmt.Errorf("unable to identify the device: %v", err)
+	}
+
+	inverter := matchProfile(ident.Model)
+	if inverter == nil {
+		return nil, errors.New("no profile for model " + ident.Model)
+	}
+	ident.Profiles = append(ident.Profiles, inverter.Name)
+
+	if raw, err := t.Read(37100, 1); err == nil && binary.BigEndian.Uint16(raw) == 1 {
+		ident.Meter = true
+		ident.Profiles = append(ident.Profiles, "sun2000-meter")
+	}
+
+	return ident, nil
+}
+
+func matchProfile(model string) *Profile {
+	for _, p := range Profiles {
+		for _, pattern := range p.Models {
+			if ok, _ := path.Match(pattern, model); ok {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+func identString(raw []byte) string {
+	return strings.TrimSpace(strings.TrimRight(string(raw), "\x00"))
+}
+
+// SUN2000-33KTL-A, configs/rfile.2000-33k-a
+const profileSun2000KTLA = `32290:2:active_power**:1000:I32:kW
+32292:2:reactive_power**:1000:I32:kVar
+32294:2:input_power**:1000:U32:kW
+32298:2:ehour**:100:U32:kWh:1h:ehour
+32345:2:ehour^p:100:U32:kWh:-1h:ehour
+32300:2:eday**:100:U32:kWh:1d/utc+5h:eday
+32349:2:eday^p:100:U32:kWh:-1d/utc+5h:eday
+32302:2:emonth**:100:U32:kWh:1m/utc+5h:emonth
+32353:2:emonth^p:100:U32:kWh:-1m/utc+5h:emonth
+32304:2:eyear:100:U32:kWh:1y/utc+5h:eyear
+32357:2:eyear^p:100:U32:kWh:-1y/utc+5h:eyear
+32343:2:ehour_ts^p:1:U32:_:none
+32347:2:eday_ts^p:1:U32:_:none
+32351:2:emonth_ts^p:1:U32:_:none
+32355:2:eyear_ts^p:1:U32:_:none
+%backfill:ehour^p:ehour_ts^p:h
+%backfill:eday^p:eday_ts^p:d
+%backfill:emonth^p:emonth_ts^p:m
+%backfill:eyear^p:eyear_ts^p:y
+32306:2:etotal**:100:U32:kWh:inf:etotal
+32286:1:temp**:10:I16:C
+32262:1:Upv1:10:I16:V
+32263:1:Ipv1:10:I16:A
+32264:1:Upv2:10:I16:V
+32265:1:Ipv2:10:I16:A
+32266:1:Upv3:10:I16:V
+32267:1:Ipv3:10:I16:A
+32268:1:Upv4:10:I16:V
+32269:1:Ipv4:10:I16:A
+32270:1:Upv5:10:I16:V
+32271:1:Ipv5:10:I16:A
+32272:1:Upv6:10:I16:V
+32273:1:Ipv6:10:I16:A
+32314:1:Upv7:10:I16:V
+32315:1:Ipv7:10:I16:A
+32316:1:Upv8:10:I16:V
+32317:1:Ipv8:10:I16:A
+32285:1:efficiency:100:U16:%%
+32322:1:ongrid**:1:U16:_
+32323:1:iResistance:1000:U16:Mohm
+33022:2:inP_MPPT1:1000:U32:kW
+33024:2:inP_MPPT2:1000:U32:kW
+33026:2:inP_MPPT3:1000:U32:kW
+33070:2:inP_MPPT4:1000:U32:kW
+32274:1:Uab:10:U16:V
+32275:1:Ubc:10:U16:V
+32276:1:Uca:10:U16:V
+32277:1:Ua:10:U16:V
+32278:1:Ub:10:U16:V
+32279:1:Uc:10:U16:V
+32280:1:Ia:10:U16:A
+32281:1:Ib:10:U16:A
+32282:1:Ic:10:U16:A
+32283:1:freq:100:U16:Hz
+32284:1:power_factor:1000:U16:_:none
+32287:1:inv_status:1:U16:_:none
+%decode:inv_status:sun2000_status
+32288:2:peak_power**:1000:I32:kW
+32319:1:s1:1:U16:_
+32320:1:s2:1:U16:_
+32321:1:s3:1:U16:_
+50000:1:a1:1:U16:_
+50001:1:a2:1:U16:_
+50002:1:a3:1:U16:_
+50003:1:a4:1:U16:_
+50004:1:a5:1:U16:_
+50005:1:a6:1:U16:_
+50006:1:a7:1:U16:_
+50007:1:a8:1:U16:_
+50008:1:a9:1:U16:_
+50009:1:a10:1:U16:_
+50010:1:a11:1:U16:_
+50011:1:a12:1:U16:_
+50012:1:a13:1:U16:_
+50013:1:a14:1:U16:_
+50014:1:a15:1:U16:_
+50015:1:a16:1:U16:_
+50016:1:a17:1:U16:_
+%check:eday:min=0,counter=d,invalid
+%check:emonth:min=0,counter=m,invalid
+%check:eyear:min=0,counter=y,invalid
+%check:etotal:counter,rate=100/h,invalid
+%check:temp:min=-40,max=120,invalid
+%energy:etotal:h,d,m,y
+`
+
+// SUN2000-30KTL-M3, the directives for the default registers, which stay
+// plain for the installs reading them without -rfile
+const profileSun2000KTLM3 = `%decode:state1:sun2000_state1
+%decode:state2:sun2000_state2
+%decode:state3:sun2000_state3
+%decode:status:sun2000_status
+%decode:alarm1:sun2000_alarm1
+%decode:alarm2:sun2000_alarm2
+%decode:alarm3:sun2000_alarm3
+%alarm:alarm1
+%alarm:alarm2
+%alarm:alarm3
+%check:eday:min=0,counter=d,invalid
+%check:etotal:counter,rate=100/h,invalid
+%check:temp:min=-40,max=120,invalid
+%energy:etotal:h,d,m,y
+`
+
+// SUN2000-20KTL-M0, configs/rfile.2000-20k-mo with 32082 named
+// reactive_power. The rfile keeps its active_power name, the field its
+// sites have the history in.
+const profileSun2000KTLM0 = `32080:2:active_power**:1000:I32:kW
+32078:2:peak_power**:1000:I32:kW
+32082:2:reactive_power**:1000:I32:kVar
+32064:2:input_power**:1000:I32:kW
+32114:2:eday**:100:U32:kWh:1d/utc+5h:eday
+32106:2:etotal**:100:U32:kWh:inf:etotal
+32087:1:temp**:10:I16:C
+32016:1:Upv1:10:I16:V
+32017:1:Ipv1:100:I16:A
+32018:1:Upv2:10:I16:V
+32019:1:Ipv2:100:I16:A
+32020:1:Upv3:10:I16:V
+32021:1:Ipv3:100:I16:A
+32022:1:Upv4:10:I16:V
+32023:1:Ipv4:100:I16:A
+32086:1:efficiency:100:U16:%%
+32088:1:iResistance:1000:U16:Mohm
+32066:1:Uab:10:U16:V
+32067:1:Ubc:10:U16:V
+32068:1:Uca:10:U16:V
+32069:1:Ua:10:U16:V
+32070:1:Ub:10:U16:V
+32071:1:Uc:10:U16:V
+32072:2:Ia:1000:I32:A
+32074:2:Ib:1000:I32:A
+32076:2:Ic:1000:I32:A
+32085:1:freq:100:U16:Hz
+32084:1:power_factor:1000:I16:_:none
+32089:1:inv_status:1:U16:_:none
+%decode:inv_status:sun2000_status
+32000:1:s1:1:U16:_
+32002:1:s2:1:U16:_
+32003:2:s3:1:U32:_
+32008:1:a1:1:U16:_
+32009:1:a2:1:U16:_
+32010:1:a3:1:U16:_
+%decode:a1:sun2000_alarm1
+%decode:a2:sun2000_alarm2
+%decode:a3:sun2000_alarm3
+%alarm:a1
+%alarm:a2
+%alarm:a3
+`
+
+// Power meter registers of the SUN2000 MODBUS Interface Definitions
+const profileSun2000Meter = `37100:1:meter_status:1:U16:_:none
+%enum:sun2000_meter_status:0=offline,1=normal
+%decode:meter_status:sun2000_meter_status
+37101:2:meter_Ua:10:I32:V
+37103:2:meter_Ub:10:I32:V
+37105:2:meter_Uc:10:I32:V
+37107:2:meter_Ia:100:I32:A
+37109:2:meter_Ib:100:I32:A
+37111:2:meter_Ic:100:I32:A
+37113:2:meter_active_power**:1000:I32:kW
+37115:2:meter_reactive_power:1000:I32:kVar
+37117:1:meter_power_factor:1000:I16:_
+37118:1:meter_freq:100:I16:Hz
+37119:2:meter_export**:100:I32:kWh:inf:meter_export
+37121:2:meter_import**:100:I32:kWh:inf:meter_import
+37132:2:meter_Pa:1000:I32:kW
+37134:2:meter_Pb:1000:I32:kW
+37136:2:meter_Pc:1000:I32:kW
+%check:meter_export:counter,invalid
+%check:meter_import:counter,invalid
+`
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,10 +20,28 @@ type Register struct {
 	unit             string
 	raw              []byte
 	value            string
+	num              float64
+	numOK            bool
 	vtype            string
+	expr             *Expr
+	codes            *CodeTable
+	scale            *Register
+	check            *Validation
+	energyPeriods    []Period
+	energyMName      string
+	align            *Alignment
+	aggFuncs         []string
+	deadband         *Deadband
+	backfill         *backfillSpec
+	alarm            bool
+	ts               time.Time
+	label            string
 	lastReadDuration time.Duration
 	lastRead         time.Time
 	lastErr          error
+	illegalCnt       int
+	disableAfter     int
+	disabled         bool
 	TsType           string
 	MName            string
 	Mutex            *sync.Mutex
@@ -32,51 +51,179 @@ func NewRegister() *Register {
 	return &Register{Mutex: &sync.Mutex{}}
 }
 
-func (r *Register) ReadHR(mbus *ModbusRTU) error {
+// ReadHR reads and parses the register. Registers answering with an
+// illegal address exception disableAfter times in a row are not read
+// anymore, ReadHR returns nil for them.
+func (r *Register) ReadHR(mbus Transport) error {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
+
+	if r.disabled || r.expr != nil {
+		return nil
+	}
+
 	r.lastErr = nil
 	t0 := time.Now()
 	r.raw, r.lastErr = mbus.Read(uint16(r.id), uint16(r.bytesCnt))
-	t1 := time.Now()
 
-	r.lastReadDuration = t1.Sub(t0)
-	r.lastRead = t1
+	r.lastReadDuration = time.Since(t0)
+	r.lastRead = transportNow(mbus)
 
 	if r.lastErr != nil {
+		var busErr *BusError
+		if errors.As(r.lastErr, &busErr) && busErr.IllegalAddress() {
+			r.illegalCnt++
+			r.disabled = r.disableAfter > 0 && r.illegalCnt >= r.disableAfter
+		} else {
+			r.illegalCnt = 0
+		}
 		return r.lastErr
 	}
 
+	r.illegalCnt = 0
+
 	r.lastErr = r.ParseResult()
+	if r.lastErr == nil && r.check != nil && r.numOK {
+		if err := r.check.Check(r.vtype, r.code(), r.num, r.lastRead); err != nil {
+			r.lastErr = &BusError{Class: ErrClassInvalid, Op: OpCheck, Addr: uint16(r.id), Err: err}
+		}
+	}
 	return r.lastErr
 }
 
+// alarmBits returns the raw content of a register read without error.
+func (r *Register) alarmBits() (uint64, bool) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	if r.lastErr != nil || len(r.raw) == 0 {
+		return 0, false
+	}
+	return r.code(), true
+}
+
+// bitLabel names bit with the bitmask table of the register.
+func (r *Register) bitLabel(bit uint) string {
+	if r.codes != nil && r.codes.Bitmask {
+		if l, ok := r.codes.Labels[uint64(bit)]; ok {
+			return l
+		}
+	}
+	return fmt.Sprintf("bit%d", bit)
+}
+
+// code is the raw register content as an unsigned number.
+func (r *Register) code() uint64 {
+	var code uint64
+	for _, b := range r.raw {
+		code = code<<8 | uint64(b)
+	}
+	return code
+}
+
 func (r *Register) ParseResult() error {
 	var v string
 	fgain := float64(r.gain)
+	r.numOK = true
 	switch r.vtype {
 	case "I32":
 		tmp := int32(binary.BigEndian.Uint32(r.raw))
-		v = fmt.Sprint(float64(tmp) / fgain)
+		r.num = float64(tmp) / fgain
 	case "U32":
 		tmp := binary.BigEndian.Uint32(r.raw)
 		if tmp == (^uint32(0)) {
 			tmp = 0
 		}
-		v = fmt.Sprint(float64(tmp) / fgain)
+		r.num = float64(tmp) / fgain
 	case "I16":
 		tmp := int16(binary.BigEndian.Uint16(r.raw))
-		v = fmt.Sprint(float64(tmp) / fgain)
+		r.num = float64(tmp) / fgain
 	case "U16":
 		tmp := binary.BigEndian.Uint16(r.raw)
-		v = fmt.Sprint(float64(tmp) / fgain)
+		r.num = float64(tmp) / fgain
 	default:
+		r.numOK = false
 		v = fmt.Sprint(r.raw)
 	}
+
+	if r.numOK && r.scale != nil {
+		sf, ok := r.scale.numeric()
+		if !ok {
+			r.numOK = false
+			return fmt.Errorf("scale factor %s not available", r.scale.name)
+		}
+		// rounded to the decimals the scale factor gives
+		p := math.Pow(10, -sf)
+		r.num = r.num / p
+		if sf < 0 {
+			r.num = math.Round(r.num*p) / p
+		}
+	}
+
+	if r.numOK {
+		v = fmt.Sprint(r.num)
+	}
 	r.value = v
+
+	if r.codes != nil {
+		r.label = r.codes.Label(r.code())
+	}
 	return nil
 }
 
+// Derived reports whether the register is computed from other registers
+// instead of being read from the bus.
+func (r *Register) Derived() bool {
+	return r.expr != nil
+}
+
+// exprName is the name other registers' expressions refer to this one by:
+// the name without the '*' markers and with '^' replaced by '_'.
+func (r *Register) exprName() string {
+	return strings.Replace(strings.Trim(r.name, "* "), "^", "_", -1)
+}
+
+// evaluate computes a derived register from vars, the numeric values of
+// the registers read or derived so far in the cycle read at t.
+func (r *Register) evaluate(vars map[string]float64, t time.Time) {
+	v, err := r.expr.Eval(vars)
+
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	r.lastRead = t
+	r.lastReadDuration = 0
+	r.lastErr = nil
+	r.numOK = false
+
+	if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		err = fmt.Errorf("result %v is not finite", v)
+	}
+	if err != nil {
+		r.lastErr = fmt.Errorf("unable to compute %s: %v", r.name, err)
+		return
+	}
+
+	if r.vtype == "I64" {
+		v = math.Round(v)
+	}
+
+	r.num = v
+	r.numOK = true
+	r.value = fmt.Sprint(v)
+}
+
+// numeric returns the value of a successfully read numeric register.
+func (r *Register) numeric() (float64, bool) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	if r.lastErr != nil || !r.numOK {
+		return 0, false
+	}
+	return r.num, true
+}
+
 func (r *Register) String() string {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
@@ -86,18 +233,80 @@ func (r *Register) String() string {
 		u = ""
 	}
 
+	if r.disabled {
+		return fmt.Sprintf("%s ## %s (disabled)", r.lastRead.Format("2006-01-02 15:04:05"), r.lastErr)
+	}
+
 	if r.lastErr != nil {
 		return fmt.Sprintf("%s ## %s", r.lastRead.Format("2006-01-02 15:04:05"), r.lastErr)
 	}
 
+	if r.expr != nil {
+		return fmt.Sprintf("%15s| %10s |=%v", r.name, r.value+u, r.expr)
+	}
+
+	if !r.ts.IsZero() {
+		return fmt.Sprintf("%15s| %10s |%s %s", r.name, r.value+u, r.MName, r.ts.Format("2006-01-02 15:04"))
+	}
+
+	if r.codes != nil {
+		return fmt.Sprintf(
+			"%15s| %10s |%v| %v | %s", r.name, r.value+u, r.id, r.lastReadDuration.Round(100*time.Microsecond), r.label,
+		)
+	}
+
 	return fmt.Sprintf(
 		"%15s| %10s |%v| %v", r.name, r.value+u, r.id, r.lastReadDuration.Round(100*time.Microsecond),
 	)
 }
 
-func GetRegistersToRead(cfg *Config) ([]*Register, error) {
-	var registersDesc []string
-	registersDesc = append(registersDesc, cfg.ReadRegistersFromCli...)
+// Reading is a point in time copy of a register, safe to hand out to
+// callers outside the poll loop.
+type Reading struct {
+	ID       uint64
+	Name     string
+	Value    string
+	Label    string
+	Unit     string
+	Err      error
+	ErrClass ErrClass
+	Disabled bool
+	LastRead time.Time
+	Duration time.Duration
+}
+
+func (r *Register) Reading() Reading {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	u := r.unit
+	if r.unit == "_" {
+		u = ""
+	}
+
+	reading := Reading{
+		ID:       r.id,
+		Name:     r.name,
+		Value:    r.value,
+		Label:    r.label,
+		Unit:     u,
+		Err:      r.lastErr,
+		Disabled: r.disabled,
+		LastRead: r.lastRead,
+		Duration: r.lastReadDuration,
+	}
+
+	if r.lastErr != nil {
+		reading.ErrClass = ClassifyError(r.lastErr)
+	}
+	return reading
+}
+
+// rfileLines returns the command line registers followed by the rfile
+// lines, without comments.
+func rfileLines(cfg *Config) ([]string, error) {
+	var lines []string
+	lines = append(lines, cfg.ReadRegistersFromCli...)
 
 	if cfg.ReadRegistersFromFile != "" {
 		content, err := ioutil.ReadFile(cfg.ReadRegistersFromFile)
@@ -110,18 +319,118 @@ func GetRegistersToRead(cfg *Config) ([]*Register, error) {
 				continue
 			}
 
-			registersDesc = append(registersDesc, line)
+			lines = append(lines, line)
 		}
 	}
+	return lines, nil
+}
+
+func GetRegistersToRead(cfg *Config) ([]*Register, error) {
+	registersDesc, err := rfileLines(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(registersDesc) == 0 {
 		return nil, errors.New("please specify some registers")
 	}
 
 	var registers []*Register
-	var err error
+
+	tables := make(map[string]*CodeTable)
+	for name, t := range BuiltinCodeTables {
+		tables[name] = t
+	}
+	var decodes, checks, energy, aggs, deadbands, backfills [][]string
+	var alarms []string
 
 	for _, r := range registersDesc {
+		if strings.HasPrefix(r, "%decode:") {
+			decode := strings.Split(r, ":")
+			if len(decode) != 3 {
+				return nil, fmt.Errorf("invalid decode line %q, want %%decode:register:table", r)
+			}
+			decodes = append(decodes, decode[1:])
+			continue
+		}
+
+		if strings.HasPrefix(r, "%check:") {
+			check := strings.SplitN(r, ":", 3)
+			if len(check) != 3 {
+				return nil, fmt.Errorf("invalid check line %q, want %%check:register:rules", r)
+			}
+			checks = append(checks, check[1:])
+			continue
+		}
+
+		if strings.HasPrefix(r, "%deadband:") {
+			d := strings.Split(r, ":")
+			if len(d) != 3 && len(d) != 4 {
+				return nil, fmt.Errorf("invalid deadband line %q, want %%deadband:register:N[%%][:heartbeat]", r)
+			}
+			deadbands = append(deadbands, append(d[1:], "")[:3])
+			continue
+		}
+
+		if strings.HasPrefix(r, "%backfill:") {
+			b := strings.Split(r, ":")
+			if len(b) != 4 {
+				return nil, fmt.Errorf("invalid backfill line %q, want %%backfill:register:time register:period", r)
+			}
+			backfills = append(backfills, b[1:])
+			continue
+		}
+
+		if strings.HasPrefix(r, "%alarm:") {
+			a := strings.Split(r, ":")
+			if len(a) != 2 {
+				return nil, fmt.Errorf("invalid alarm line %q, want %%alarm:register", r)
+			}
+			alarms = append(alarms, a[1])
+			continue
+		}
+
+		if strings.HasPrefix(r, "%history:") || strings.HasPrefix(r, "%hfield:") {
+			// see GetHistoryFiles
+			continue
+		}
+
+		if strings.HasPrefix(r, "%agg:") {
+			agg := strings.Split(r, ":")
+			if len(agg) != 3 {
+				return nil, fmt.Errorf("invalid agg line %q, want %%agg:register:funcs", r)
+			}
+			aggs = append(aggs, agg[1:])
+			continue
+		}
+
+		if strings.HasPrefix(r, "%energy:") {
+			e := strings.Split(r, ":")
+			if len(e) != 3 && len(e) != 4 {
+				return nil, fmt.Errorf("invalid energy line %q, want %%energy:register:periods[:measurement]", r)
+			}
+			energy = append(energy, e[1:])
+			continue
+		}
+
+		if strings.HasPrefix(r, "%") {
+			t, err := ParseCodeTable(r)
+			if err != nil {
+				return nil, err
+			}
+			tables[t.Name] = t
+			continue
+		}
+
+		if strings.HasPrefix(r, "=") {
+			derived, err := parseDerived(cfg, r)
+			if err != nil {
+				return nil, err
+			}
+			registers = append(registers, derived)
+			continue
+		}
+
 		//register_id:total_bytes_toread:short_name:gain:register_type:unit
 		rinfo := strings.Split(r, ":")
 
@@ -133,6 +442,7 @@ func GetRegistersToRead(cfg *Config) ([]*Register, error) {
 
 		r.TsType = cfg.DefaultTsType
 		r.MName = cfg.DefaultMName
+		r.disableAfter = cfg.DisableAfter
 		r.id, err = strconv.ParseUint(rinfo[0], 10, 16)
 
 		if err != nil {
@@ -163,8 +473,293 @@ func GetRegistersToRead(cfg *Config) ([]*Register, error) {
 			r.MName = rinfo[7]
 		}
 
+		if r.align, err = ParseAlignment(r.TsType); err != nil {
+			return nil, fmt.Errorf("register %s: %v", r.name, err)
+		}
+
 		registers = append(registers, r)
 	}
 
+	for _, r := range registers {
+		if r.align.Register != "" && len(registersNamed(registers, r.align.Register)) == 0 {
+			return nil, fmt.Errorf("register %s: timestamp register %s not found", r.name, r.align.Register)
+		}
+	}
+
+	for _, decode := range decodes {
+		t, ok := tables[decode[1]]
+		if !ok {
+			return nil, fmt.Errorf("decode %s: unknown code table %s", decode[0], decode[1])
+		}
+
+		matched := busRegistersNamed(registers, decode[0])
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("decode %s: no such register", decode[0])
+		}
+		for _, r := range matched {
+			r.codes = t
+		}
+	}
+
+	for _, check := range checks {
+		matched := busRegistersNamed(registers, check[0])
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("check %s: no such register", check[0])
+		}
+		for _, r := range matched {
+			if r.check, err = ParseValidation(check[1], cfg.Location); err != nil {
+				return nil, fmt.Errorf("check %s: %v", check[0], err)
+			}
+		}
+	}
+
+	for _, e := range energy {
+		var periods []Period
+		for _, s := range strings.Split(e[1], ",") {
+			p, err := ParsePeriod(s)
+			if err != nil {
+				return nil, fmt.Errorf("energy %s: %v", e[0], err)
+			}
+			periods = append(periods, p)
+		}
+
+		mname := "energy"
+		if len(e) == 3 {
+			mname = e[2]
+		}
+
+		matched := registersNamed(registers, e[0])
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("energy %s: no such register", e[0])
+		}
+		for _, r := range matched {
+			r.energyPeriods, r.energyMName = periods, mname
+		}
+	}
+
+	for _, agg := range aggs {
+		funcs := strings.Split(agg[1], ",")
+		for _, fn := range funcs {
+			known := false
+			for _, f := range AggFuncs {
+				known = known || f == fn
+			}
+			if !known {
+				return nil, fmt.Errorf("agg %s: unknown function %s, want one of %s", agg[0], fn, strings.Join(AggFuncs, ","))
+			}
+		}
+
+		matched := registersNamed(registers, agg[0])
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("agg %s: no such register", agg[0])
+		}
+		for _, r := range matched {
+			r.aggFuncs = funcs
+		}
+	}
+
+	for _, d := range deadbands {
+		deadband, err := ParseDeadband(d[1], d[2])
+		if err != nil {
+			return nil, fmt.Errorf("deadband %s: %v", d[0], err)
+		}
+
+		matched := registersNamed(registers, d[0])
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("deadband %s: no such register", d[0])
+		}
+		for _, r := range matched {
+			r.deadband = deadband
+		}
+	}
+
+	for _, b := range backfills {
+		period, err := ParsePeriod(b[2])
+		if err != nil {
+			return nil, fmt.Errorf("backfill %s: %v", b[0], err)
+		}
+
+		times := busRegistersNamed(registers, b[1])
+		if len(times) != 1 {
+			return nil, fmt.Errorf("backfill %s: time register %s not found", b[0], b[1])
+		}
+
+		matched := busRegistersNamed(registers, b[0])
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("backfill %s: no such register", b[0])
+		}
+		for _, r := range matched {
+			r.backfill = &backfillSpec{period: period, time: times[0]}
+		}
+	}
+
+	for _, a := range alarms {
+		matched := busRegistersNamed(registers, a)
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("alarm %s: no such register", a)
+		}
+		for _, r := range matched {
+			r.alarm = true
+		}
+	}
+
+	if _, err := DerivedOrder(registers); err != nil {
+		return nil, err
+	}
+
 	return registers, nil
 }
+
+// busRegistersNamed returns the registers read from the bus called name,
+// with or without the '*' markers.
+func busRegistersNamed(registers []*Register, name string) []*Register {
+	var matched []*Register
+	for _, r := range registersNamed(registers, name) {
+		if r.expr == nil {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+// registersNamed is busRegistersNamed including derived registers.
+func registersNamed(registers []*Register, name string) []*Register {
+	var matched []*Register
+	for _, r := range registers {
+		if r.name == name || strings.Trim(r.name, "* ") == name {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+// parseDerived parses "=name:type:unit:expression[:timestamp offset[:measurement]]"
+// where type is F64 or I64 (rounded).
+func parseDerived(cfg *Config, desc string) (*Register, error) {
+	rinfo := strings.Split(strings.TrimPrefix(desc, "="), ":")
+	if len(rinfo) < 4 {
+		return nil, fmt.Errorf("invalid derived register %q", desc)
+	}
+
+	r := NewRegister()
+	r.TsType = cfg.DefaultTsType
+	r.MName = cfg.DefaultMName
+	r.name = rinfo[0]
+	r.vtype = rinfo[1]
+	r.unit = rinfo[2]
+	r.gain = 1
+
+	if r.vtype != "F64" && r.vtype != "I64" {
+		return nil, fmt.Errorf("derived register %s: type must be F64 or I64", r.name)
+	}
+
+	expr, err := ParseExpr(rinfo[3])
+	if err != nil {
+		return nil, fmt.Errorf("derived register %s: %v", r.name, err)
+	}
+	r.expr = expr
+
+	if len(rinfo) >= 5 {
+		r.TsType = rinfo[4]
+	}
+
+	if len(rinfo) >= 6 {
+		r.MName = rinfo[5]
+	}
+
+	if r.align, err = ParseAlignment(r.TsType); err != nil {
+		return nil, fmt.Errorf("derived register %s: %v", r.name, err)
+	}
+
+	return r, nil
+}
+
+// DerivedOrder returns the derived registers ordered so that every one
+// comes after the derived registers it depends on. Unknown names and
+// dependency cycles are errors.
+func DerivedOrder(registers []*Register) ([]*Register, error) {
+	byName := make(map[string]*Register)
+	for _, r := range registers {
+		byName[r.exprName()] = r
+	}
+
+	var ordered []*Register
+	state := make(map[*Register]int) // 1 visiting, 2 done
+
+	var visit func(r *Register) error
+	visit = func(r *Register) error {
+		switch state[r] {
+		case 1:
+			return fmt.Errorf("derived register %s is part of a dependency cycle", r.name)
+		case 2:
+			return nil
+		}
+
+		state[r] = 1
+		for _, name := range r.expr.Names() {
+			dep, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("derived register %s: unknown register %s", r.name, name)
+			}
+			if dep.expr != nil {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		state[r] = 2
+		ordered = append(ordered, r)
+		return nil
+	}
+
+	for _, r := range registers {
+		if r.expr == nil {
+			continue
+		}
+		if err := visit(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// EvalDerived computes the derived registers, in DerivedOrder, from the
+// values of this cycle.
+func EvalDerived(registers []*Register, derived []*Register) {
+	now := cycleTime(registers)
+	vars := make(map[string]float64)
+	for _, r := range registers {
+		if r.expr != nil {
+			continue
+		}
+		if v, ok := r.numeric(); ok {
+			vars[r.exprName()] = v
+		}
+	}
+
+	for _, r := range derived {
+		r.evaluate(vars, now)
+		if v, ok := r.numeric(); ok {
+			vars[r.exprName()] = v
+		}
+	}
+}
+
+// cycleTime is when registers were read: the latest read among the ones
+// without a point time of their own, the host clock when there is none.
+// Replayed registers carry the recorded time, see TimeSource.
+func cycleTime(registers []*Register) time.Time {
+	var latest time.Time
+	for _, r := range registers {
+		r.Mutex.Lock()
+		if r.ts.IsZero() && r.lastRead.After(latest) {
+			latest = r.lastRead
+		}
+		r.Mutex.Unlock()
+	}
+	if latest.IsZero() {
+		return time.Now()
+	}
+	return latest
+}
@@ -0,0 +1,280 @@
+package solarmon
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+// ScanOptions describe which serial settings, slave IDs and addresses a
+// bus scan tries.
+type ScanOptions struct {
+	SlaveIDs  []int
+	BaudRates []int
+	Parities  []string
+	ProbeAddr uint16
+	From      uint16
+	To        uint16
+	Block     uint16
+}
+
+// ScanDevice is a slave that answered the probe read, together with the
+// addresses found during the sweep.
+type ScanDevice struct {
+	SlaveID   byte
+	BaudRate  int
+	Parity    string
+	Registers []ScanRegister
+}
+
+// ScanRegister is the outcome of reading a single address. Exception is
+// the modbus exception code, zero when the address answered.
+type ScanRegister struct {
+	Addr      uint16
+	Answered  bool
+	Raw       uint16
+	Exception byte
+}
+
+func NewScanOptions(cfg *Config) (ScanOptions, error) {
+	var err error
+	opts := ScanOptions{
+		ProbeAddr: uint16(cfg.ScanProbe),
+		From:      uint16(cfg.ScanFrom),
+		To:        uint16(cfg.ScanTo),
+		Block:     uint16(cfg.ScanBlock),
+	}
+
+	if opts.SlaveIDs, err = parseIntList(cfg.ScanSlaveIDs, 1, 247); err != nil {
+		return opts, fmt.Errorf("invalid scan slave ids: %v", err)
+	}
+
+	if opts.BaudRates, err = parseIntList(cfg.ScanBaudRates, 50, maxScanBaudRate); err != nil {
+		return opts, fmt.Errorf("invalid scan baud rates: %v", err)
+	}
+
+	for _, p := range strings.Split(cfg.ScanParities, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			opts.Parities = append(opts.Parities, p)
+		}
+	}
+
+	if len(opts.SlaveIDs) == 0 || len(opts.BaudRates) == 0 || len(opts.Parities) == 0 {
+		return opts, errors.New("scan needs at least one slave id, baud rate and parity")
+	}
+
+	if opts.Block < 1 || opts.Block > 125 {
+		return opts, errors.New("scan block must be between 1 and 125")
+	}
+
+	if opts.To < opts.From {
+		return opts, errors.New("scan range end is before its start")
+	}
+
+	return opts, nil
+}
+
+// Scan probes every slave ID with every baud rate/parity combination and
+// sweeps the register range of each device that answered. Progress is
+// reported through logf.
+func Scan(ctx context.Context, cfg *Config, opts ScanOptions, logf func(string, ...interface{})) ([]*ScanDevice, error) {
+	var devices []*ScanDevice
+
+	for _, baudRate := range opts.BaudRates {
+		for _, parity := range opts.Parities {
+			c := *cfg
+			c.BaudRate = baudRate
+			c.ModbusParity = parity
+
+			found, err := scanBus(ctx, &c, opts, logf)
+			devices = append(devices, found...)
+			if err != nil {
+				return devices, err
+			}
+		}
+	}
+
+	return devices, nil
+}
+
+func scanBus(ctx context.Context, cfg *Config, opts ScanOptions, logf func(string, ...interface{})) ([]*ScanDevice, error) {
+	var devices []*ScanDevice
+
+	mbus, err := NewModbusRTU(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer mbus.Close()
+
+	client, err := mbus.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	logf("scanning br=%d prty=%s ids=%d", cfg.BaudRate, cfg.ModbusParity, len(opts.SlaveIDs))
+
+	for _, id := range opts.SlaveIDs {
+		if ctx.Err() != nil {
+			return devices, ctx.Err()
+		}
+
+		mbus.SetSlaveID(byte(id))
+		_, err := client.ReadHoldingRegisters(opts.ProbeAddr, 1)
+		if _, ok := exceptionCode(err); err != nil && !ok {
+			scanRecover(mbus, err)
+			continue
+		}
+
+		logf("found slave id=%d br=%d prty=%s", id, cfg.BaudRate, cfg.ModbusParity)
+
+		device := &ScanDevice{SlaveID: byte(id), BaudRate: cfg.BaudRate, Parity: cfg.ModbusParity}
+		if err := sweep(ctx, mbus, client, device, opts, logf); err != nil {
+			return append(devices, device), err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// sweep reads the range in blocks. A block answering with an exception is
+// retried address by address, as a single unmapped address fails the whole
+// block on most inverters.
+func sweep(ctx context.Context, mbus *ModbusRTU, client modbus.Client, device *ScanDevice, opts ScanOptions, logf func(string, ...interface{})) error {
+	for addr := uint32(opts.From); addr <= uint32(opts.To); addr += uint32(opts.Block) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		cnt := uint32(opts.Block)
+		if addr+cnt-1 > uint32(opts.To) {
+			cnt = uint32(opts.To) - addr + 1
+		}
+
+		raw, err := client.ReadHoldingRegisters(uint16(addr), uint16(cnt))
+		if err == nil && len(raw) == int(cnt)*2 {
+			for i := uint32(0); i < cnt; i++ {
+				device.Registers = append(device.Registers, ScanRegister{
+					Addr:     uint16(addr + i),
+					Answered: true,
+					Raw:      binary.BigEndian.Uint16(raw[i*2:]),
+				})
+			}
+			continue
+		}
+
+		for i := uint32(0); i < cnt; i++ {
+			r := ScanRegister{Addr: uint16(addr + i)}
+			raw, err := client.ReadHoldingRegisters(r.Addr, 1)
+			switch code, ok := exceptionCode(err); {
+			case err == nil && len(raw) == 2:
+				r.Answered = true
+				r.Raw = binary.BigEndian.Uint16(raw)
+			case ok:
+				r.Exception = code
+			default:
+				scanRecover(mbus, err)
+				continue
+			}
+			device.Registers = append(device.Registers, r)
+		}
+	}
+
+	logf("slave id=%d: %d of %d addresses answered", device.SlaveID, device.Answered(), int(opts.To)-int(opts.From)+1)
+	return nil
+}
+
+func (d *ScanDevice) Answered() int {
+	n := 0
+	for _, r := range d.Registers {
+		if r.Answered {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteDraftRfile writes every answered address as a U16 rfile line, to be
+// renamed and merged into real registers by hand.
+func WriteDraftRfile(w io.Writer, devices []*ScanDevice) error {
+	for _, d := range devices {
+		_, err := fmt.Fprintf(w, "# slaveId=%d br=%d prty=%s answered=%d\n", d.SlaveID, d.BaudRate, d.Parity, d.Answered())
+		if err != nil {
+			return err
+		}
+
+		for _, r := range d.Registers {
+			if !r.Answered {
+				_, err = fmt.Fprintf(w, "#%d exception=%d\n", r.Addr, r.Exception)
+			} else {
+				_, err = fmt.Fprintf(w, "#raw=%d 0x%04X\n%d:1:r%d:1:U16:_\n", r.Raw, r.Raw, r.Addr, r.Addr)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func exceptionCode(err error) (byte, bool) {
+	var mbErr *modbus.ModbusError
+	if errors.As(err, &mbErr) {
+		return mbErr.ExceptionCode, true
+	}
+	return 0, false
+}
+
+// scanRecover reopens the port after garbage on the line, a plain timeout
+// leaves nothing behind to flush.
+func scanRecover(mbus *ModbusRTU, err error) {
+	if err != nil && err != serial.ErrTimeout {
+		mbus.Reconnect()
+	}
+}
+
+// maxScanBaudRate is above any RS485 adapter rate.
+const maxScanBaudRate = 4000000
+
+// parseIntList parses "1-10,15,20-22" style lists of values between min
+// and max, checked before a range is expanded.
+func parseIntList(s string, min, max int) ([]int, error) {
+	var list []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if from < min || to > max {
+			return nil, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+		if from > to {
+			return nil, fmt.Errorf("%s is an empty range", part)
+		}
+
+		for i := from; i <= to; i++ {
+			list = append(list, i)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,74 @@
+package solarmon
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestParseIntList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []int
+		err  bool
+	}{
+		{list: "1", want: []int{1}},
+		{list: "1-3,7, 9-10", want: []int{1, 2, 3, 7, 9, 10}},
+		{list: "247", want: []int{247}},
+		{list: "", want: nil},
+		{list: "0", err: true},
+		{list: "248", err: true},
+		{list: "1-4000000000", err: true},
+		{list: "200-300", err: true},
+		{list: "5-3", err: true},
+		{list: "-5", err: true},
+		{list: "1-x", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseIntList(tt.list, 1, 247)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: got %v, want an error", tt.list, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v %v, want %v", tt.list, got, err, tt.want)
+		}
+	}
+}
+
+func TestWriteDraftRfile(t *testing.T) {
+	devices := []*ScanDevice{
+		{SlaveID: 1, BaudRate: 9600, Parity: "N", Registers: []ScanRegister{
+			{Addr: 32000, Answered: true, Raw: 0x0200},
+			{Addr: 32001, Exception: 2},
+			{Addr: 32002, Answered: true, Raw: 65535},
+		}},
+		{SlaveID: 3, BaudRate: 19200, Parity: "E"},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDraftRfile(&buf, devices); err != nil {
+		t.Fatal(err)
+	}
+
+	golden := "testdata/draft.rfile"
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got\n%s\nwant\n%s", buf.Bytes(), want)
+	}
+}
@@ -0,0 +1,175 @@
+package solarmon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// secretValue returns value when set, else the first of the environment
+// variables env, the file named by env_FILE or the systemd credential
+// named like env in lower case without the SOLARMON_ prefix, e.g.
+// influx_password for SOLARMON_INFLUX_PASSWORD.
+func secretValue(value string, env ...string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+
+	for _, name := range env {
+		if v := os.Getenv(name); v != "" {
+			return v, nil
+		}
+		if file := os.Getenv(name + "_FILE"); file != "" {
+			return readSecret(file)
+		}
+	}
+
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", nil
+	}
+	for _, name := range env {
+		file := filepath.Join(dir, strings.ToLower(strings.TrimPrefix(name, "SOLARMON_")))
+		if _, err := os.Stat(file); err == nil {
+			return readSecret(file)
+		}
+	}
+	return "", nil
+}
+
+func readSecret(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret: %v", err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Redactor hides secrets in text written to logs, HTTP pages and stdout:
+// the values added with Add and the passwords of URIs. Every Config has
+// its own, see Config.Secrets. A nil Redactor only hides the URI
+// passwords.
+type Redactor struct {
+	mutex  *sync.Mutex
+	values []string
+	short  []string
+}
+
+// minSecretLen is the shortest secret Redact replaces in text, replacing
+// shorter ones would hide parts of unrelated words all over the logs.
+const minSecretLen = 4
+
+// NewRedactor returns a redactor without secrets.
+func NewRedactor() *Redactor {
+	return &Redactor{mutex: &sync.Mutex{}}
+}
+
+var (
+	uriPassword = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/@:\s]*:)[^@/\s]*@`)
+	uriQuery    = regexp.MustCompile(`([?&](?:p|password|token)=)[^&\s'"]*`)
+)
+
+// Add registers secret, named for Short. Empty ones are skipped, ones
+// shorter than 4 characters are only noted: Redact leaves them in the
+// text, the fields holding them are still hidden as a whole.
+func (r *Redactor) Add(name, secret string) {
+	if secret == "" {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(secret) < minSecretLen {
+		r.short = append(r.short, name)
+		return
+	}
+	for _, v := range r.values {
+		if v == secret {
+			return
+		}
+	}
+	r.values = append(r.values, secret)
+}
+
+// Short returns the names of the secrets too short to redact in text.
+func (r *Redactor) Short() []string {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.short...)
+}
+
+// Redact replaces the secrets in s with REDACTED.
+func (r *Redactor) Redact(s string) string {
+	s = uriPassword.ReplaceAllString(s, "${1}REDACTED@")
+	s = uriQuery.ReplaceAllString(s, "${1}REDACTED")
+	if r == nil {
+		return s
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, "REDACTED")
+	}
+	return s
+}
+
+// redactHandler passes the records on with their message and string or
+// error attributes redacted by secrets.
+type redactHandler struct {
+	slog.Handler
+	secrets *Redactor
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, h.secrets.Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.secrets.redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.secrets.redactAttr(a))
+	}
+	return &redactHandler{h.Handler.WithAttrs(redacted), h.secrets}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{h.Handler.WithGroup(name), h.secrets}
+}
+
+func (r *Redactor) redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.Redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		redacted := make([]interface{}, 0, len(group))
+		for _, g := range group {
+			redacted = append(redacted, r.redactAttr(g))
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, r.Redact(x.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, r.Redact(x.String()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
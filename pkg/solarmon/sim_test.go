@@ -0,0 +1,365 @@
+package solarmon
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tolivb/go-mbpool/pkg/mbsim"
+)
+
+const simRfile = "../../configs/rfile.2000-33k-a"
+
+// simulator serves the ktl33 map and simRfile at 12:30, over Modbus TCP
+// and, where pseudo terminals work, over RTU.
+type simulator struct {
+	tcp string
+	tty string
+}
+
+func startSimulator(t *testing.T) *simulator {
+	t.Helper()
+
+	var registers []*mbsim.Register
+	for _, file := range []string{"../../configs/ktl33.json", simRfile} {
+		var regs []*mbsim.Register
+		var err error
+		if strings.HasSuffix(file, ".json") {
+			regs, err = mbsim.LoadJSON(file)
+		} else {
+			regs, err = mbsim.LoadRfile(file)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		registers = append(registers, regs...)
+	}
+
+	signals, err := mbsim.ParseScript(strings.NewReader(mbsim.DefaultScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mbsim.NewMap(registers)
+	m.Apply(signals)
+	y, mo, d := time.Now().Date()
+	m.Update(time.Date(y, mo, d, 12, 30, 0, 0, time.Local))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &simulator{tcp: ln.Addr().String()}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		mbsim.ServeTCP(ctx, ln, m)
+	}()
+
+	pty, err := mbsim.OpenPTY()
+	if err != nil {
+		t.Logf("no RTU simulator: %v", err)
+		return s
+	}
+	s.tty = pty.Name
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		mbsim.ServeRTU(ctx, pty.Master, 1, m)
+	}()
+	// closing the master ends ServeRTU
+	t.Cleanup(func() { pty.Close() })
+	return s
+}
+
+// transports lists the command line selecting each transport served.
+func (s *simulator) transports() map[string][]string {
+	args := map[string][]string{"tcp": {"-tcp", s.tcp}}
+	if s.tty != "" {
+		args["rtu"] = []string{"-tty", s.tty, "-slaveId", "1"}
+	}
+	return args
+}
+
+func simConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	cfg, err := NewConfig(flag.NewFlagSet("test", flag.ContinueOnError), args, "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestSimulatorTransports(t *testing.T) {
+	sim := startSimulator(t)
+
+	for name, args := range sim.transports() {
+		t.Run(name, func(t *testing.T) {
+			cfg := simConfig(t, args...)
+			transport, err := NewTransport(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+
+			// active power, I32 kW with gain 1000
+			resp, err := transport.Read(32290, 2)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if len(resp) != 4 {
+				t.Fatalf("read: got %d bytes, want 4", len(resp))
+			}
+			if w := int32(uint32(resp[0])<<24 | uint32(resp[1])<<16 | uint32(resp[2])<<8 | uint32(resp[3])); w < 1000 {
+				t.Errorf("active power: got %d W, want daylight production", w)
+			}
+
+			_, err = transport.Read(1, 1)
+			var busErr *BusError
+			if !errors.As(err, &busErr) || !busErr.IllegalAddress() {
+				t.Errorf("unmapped address: got %v, want an illegal address exception", err)
+			}
+
+			writer, ok := transport.(RegisterWriter)
+			if !ok {
+				t.Fatal("transport can not write")
+			}
+			if err := writer.Write(32290, []byte{0, 0, 0x30, 0x39}); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if resp, err = transport.Read(32290, 2); err != nil || resp[2] != 0x30 || resp[3] != 0x39 {
+				t.Errorf("read back: got % x %v, want 00 00 30 39", resp, err)
+			}
+
+			// the exception is an answer, the link stays healthy
+			if h := transport.(HealthReporter).Health(); h.State != HealthHealthy {
+				t.Errorf("health: got %s, want %s", h.State, HealthHealthy)
+			}
+		})
+	}
+}
+
+type recordingOutput struct {
+	registers []*Register
+	events    []Event
+}
+
+func (o *recordingOutput) WriteRegisters(registers []*Register) error {
+	o.registers = registers
+	return nil
+}
+
+func (o *recordingOutput) WriteEvent(e Event) error {
+	o.events = append(o.events, e)
+	return nil
+}
+
+func TestSimulatorPoll(t *testing.T) {
+	sim := startSimulator(t)
+
+	for name, args := range sim.transports() {
+		t.Run(name, func(t *testing.T) {
+			var bodies []string
+			influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer influx.Close()
+
+			rec := &recordingOutput{}
+			cfg := simConfig(t, append(args, "-rfile", simRfile)...)
+			p, err := NewPoller(Options{
+				Config: cfg,
+				Outputs: map[string]Output{
+					"rec":    rec,
+					"influx": NewInfluxOutput(influx.URL+"/write?db=test", cfg.InfluxTags, false, nil),
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Shutdown(context.Background())
+
+			if err := p.Poll(context.Background()); err != nil {
+				t.Fatalf("poll: %v", err)
+			}
+
+			power := -1.0
+			for _, r := range p.Snapshot() {
+				if r.Err != nil {
+					t.Errorf("%s: %v", r.Name, r.Err)
+				}
+				if strings.Trim(r.Name, "* ") == "active_power" {
+					power, _ = strconv.ParseFloat(r.Value, 64)
+				}
+			}
+			if power < 1 {
+				t.Errorf("active_power: got %v kW, want daylight production", power)
+			}
+
+			if len(rec.registers) < len(p.Snapshot()) {
+				t.Errorf("output got %d registers, want at least %d", len(rec.registers), len(p.Snapshot()))
+			}
+			var cycle *CycleCompleted
+			for _, e := range rec.events {
+				if c, ok := e.(CycleCompleted); ok {
+					cycle = &c
+				}
+			}
+			if cycle == nil || cycle.Failed != 0 || cycle.Held {
+				t.Errorf("cycle event: got %+v, want one without failures", cycle)
+			}
+
+			if len(bodies) == 0 || !strings.Contains(bodies[0], "solar,loc=1,type=1,inverter=ktl33 ") ||
+				!strings.Contains(bodies[0], "active_power=") {
+				t.Errorf("influx: got %q, want the solar measurement with active_power", bodies)
+			}
+		})
+	}
+}
+
+// clockedTransport answers from the simulator on the clock of the test,
+// the readings are stamped with now like replayed ones.
+type clockedTransport struct {
+	Transport
+	now time.Time
+}
+
+func (t *clockedTransport) Now() time.Time {
+	return t.now
+}
+
+func TestBusErrorsDownsampled(t *testing.T) {
+	sim := startSimulator(t)
+
+	var bodies []string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	// not in the simulator map
+	rfile := filepath.Join(t.TempDir(), "rfile")
+	if err := ioutil.WriteFile(rfile, []byte("32290:2:active_power**:1000:I32:kW\n1:1:missing:1:U16:x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := simConfig(t, "-tcp", sim.tcp, "-rfile", rfile)
+	out, err := NewDownsampleOutput(NewInfluxOutput(influx.URL+"/write?db=test", cfg.InfluxTags, false, nil), "5m", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := NewTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &clockedTransport{Transport: live, now: time.Date(2024, time.June, 1, 12, 0, 0, 0, time.Local)}
+	p, err := NewPoller(Options{Config: cfg, Transport: clock, Outputs: map[string]Output{"influx": out}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+
+	// the second poll closes the window of the first
+	p.Poll(context.Background())
+	clock.now = clock.now.Add(5 * time.Minute)
+	p.Poll(context.Background())
+
+	all := strings.Join(bodies, "")
+	if !strings.Contains(all, "bus_errors,") || !strings.Contains(all, "err_exception=1i") {
+		t.Errorf("influx: got %q, want bus_errors with the failed register", all)
+	}
+}
+
+func TestNightModeEventsDuringPoll(t *testing.T) {
+	sim := startSimulator(t)
+
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	// night around the clock, every toggle sends an event
+	cfg := simConfig(t, "-tcp", sim.tcp, "-rfile", simRfile, "-interval", "1ms",
+		"-nightmodeStart", "19", "-nightmodeEnd", "18", "-nightmodeSleep", "1ms")
+	p, err := NewPoller(Options{
+		Config:  cfg,
+		Outputs: map[string]Output{"influx": NewInfluxOutput(influx.URL+"/write?db=test", cfg.InfluxTags, false, nil)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+
+	// /api/poll runs cycles next to Run
+	for i := 0; i < 20; i++ {
+		p.nmode.Store(i%2 == 0)
+		p.Poll(context.Background())
+	}
+	cancel()
+	<-done
+}
+
+func TestBusErrorsDerived(t *testing.T) {
+	sim := startSimulator(t)
+
+	// missing is not in the simulator map, both derived registers fail with it
+	rfile := filepath.Join(t.TempDir(), "rfile")
+	lines := "32290:2:active_power**:1000:I32:kW\n1:1:missing:1:U16:x\n" +
+		"=missing2:F64:x:missing*2\n=missing4:F64:x:missing2*2\n"
+	if err := ioutil.WriteFile(rfile, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingOutput{}
+	p, err := NewPoller(Options{
+		Config:  simConfig(t, "-tcp", sim.tcp, "-rfile", rfile),
+		Outputs: map[string]Output{"rec": rec},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+
+	p.Poll(context.Background())
+
+	var cycle *CycleCompleted
+	for _, e := range rec.events {
+		if c, ok := e.(CycleCompleted); ok {
+			cycle = &c
+		}
+	}
+	if cycle == nil {
+		t.Fatal("no cycle event")
+	}
+	want := map[ErrClass]int{ErrClassException: 1}
+	for _, class := range ErrClasses {
+		if cycle.Errors[class] != want[class] {
+			t.Errorf("%s: got %d, want %d", class, cycle.Errors[class], want[class])
+		}
+	}
+}
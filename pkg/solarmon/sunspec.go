@@ -0,0 +1,364 @@
+package solarmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SunSpecBases are the addresses the "SunS" marker is looked for at.
+var SunSpecBases = []uint16{40000, 50000, 0}
+
+const sunSpecMarker = 0x53756e53 // "SunS"
+
+// SunSpecDevice is what the discovery found: the common model strings and
+// the chain of model IDs with their start address.
+type SunSpecDevice struct {
+	Base         uint16
+	Manufacturer string
+	Model        string
+	Version      string
+	Serial       string
+	Models       []SunSpecModel
+}
+
+type SunSpecModel struct {
+	ID     uint16
+	Addr   uint16
+	Length uint16
+}
+
+func (d *SunSpecDevice) String() string {
+	var ids []string
+	for _, m := range d.Models {
+		ids = append(ids, fmt.Sprint(m.ID))
+	}
+	return fmt.Sprintf(
+		"%s %s version=%s sn=%s base=%d models=%s",
+		d.Manufacturer, d.Model, d.Version, d.Serial, d.Base, strings.Join(ids, ","),
+	)
+}
+
+// sunSpecPoint is a point of a model, Offset counts from the first
+// register after the model ID and length. SF names the scale factor point.
+type sunSpecPoint struct {
+	Name   string
+	Offset uint16
+	Type   string
+	Unit   string
+	SF     string
+	Codes  string
+}
+
+var sunSpecInverter = []sunSpecPoint{
+	{"A", 0, "uint16", "A", "A_SF", ""},
+	{"AphA", 1, "uint16", "A", "A_SF", ""},
+	{"AphB", 2, "uint16", "A", "A_SF", ""},
+	{"AphC", 3, "uint16", "A", "A_SF", ""},
+	{"A_SF", 4, "sunssf", "", "", ""},
+	{"PPVphAB", 5, "uint16", "V", "V_SF", ""},
+	{"PPVphBC", 6, "uint16", "V", "V_SF", ""},
+	{"PPVphCA", 7, "uint16", "V", "V_SF", ""},
+	{"PhVphA", 8, "uint16", "V", "V_SF", ""},
+	{"PhVphB", 9, "uint16", "V", "V_SF", ""},
+	{"PhVphC", 10, "uint16", "V", "V_SF", ""},
+	{"V_SF", 11, "sunssf", "", "", ""},
+	{"W**", 12, "int16", "W", "W_SF", ""},
+	{"W_SF", 13, "sunssf", "", "", ""},
+	{"Hz", 14, "uint16", "Hz", "Hz_SF", ""},
+	{"Hz_SF", 15, "sunssf", "", "", ""},
+	{"VA", 16, "int16", "VA", "VA_SF", ""},
+	{"VA_SF", 17, "sunssf", "", "", ""},
+	{"VAr", 18, "int16", "var", "VAr_SF", ""},
+	{"VAr_SF", 19, "sunssf", "", "", ""},
+	{"PF", 20, "int16", "%", "PF_SF", ""},
+	{"PF_SF", 21, "sunssf", "", "", ""},
+	{"WH**", 22, "acc32", "Wh", "WH_SF", ""},
+	{"WH_SF", 24, "sunssf", "", "", ""},
+	{"DCA", 25, "uint16", "A", "DCA_SF", ""},
+	{"DCA_SF", 26, "sunssf", "", "", ""},
+	{"DCV", 27, "uint16", "V", "DCV_SF", ""},
+	{"DCV_SF", 28, "sunssf", "", "", ""},
+	{"DCW**", 29, "int16", "W", "DCW_SF", ""},
+	{"DCW_SF", 30, "sunssf", "", "", ""},
+	{"TmpCab**", 31, "int16", "C", "Tmp_SF", ""},
+	{"TmpSnk", 32, "int16", "C", "Tmp_SF", ""},
+	{"TmpTrns", 33, "int16", "C", "Tmp_SF", ""},
+	{"TmpOt", 34, "int16", "C", "Tmp_SF", ""},
+	{"Tmp_SF", 35, "sunssf", "", "", ""},
+	{"St**", 36, "enum16", "_", "", "sunspec_inverter_state"},
+	{"Evt1", 38, "bitfield32", "_", "", "sunspec_inverter_events"},
+}
+
+var sunSpecMeter = []sunSpecPoint{
+	{"A", 0, "int16", "A", "A_SF", ""},
+	{"AphA", 1, "int16", "A", "A_SF", ""},
+	{"AphB", 2, "int16", "A", "A_SF", ""},
+	{"AphC", 3, "int16", "A", "A_SF", ""},
+	{"A_SF", 4, "sunssf", "", "", ""},
+	{"PhV", 5, "int16", "V", "V_SF", ""},
+	{"PhVphA", 6, "int16", "V", "V_SF", ""},
+	{"PhVphB", 7, "int16", "V", "V_SF", ""},
+	{"PhVphC", 8, "int16", "V", "V_SF", ""},
+	{"PPV", 9, "int16", "V", "V_SF", ""},
+	{"V_SF", 13, "sunssf", "", "", ""},
+	{"Hz", 14, "int16", "Hz", "Hz_SF", ""},
+	{"Hz_SF", 15, "sunssf", "", "", ""},
+	{"W**", 16, "int16", "W", "W_SF", ""},
+	{"WphA", 17, "int16", "W", "W_SF", ""},
+	{"WphB", 18, "int16", "W", "W_SF", ""},
+	{"WphC", 19, "int16", "W", "W_SF", ""},
+	{"W_SF", 20, "sunssf", "", "", ""},
+	{"VA", 21, "int16", "VA", "VA_SF", ""},
+	{"VA_SF", 25, "sunssf", "", "", ""},
+	{"VAR", 26, "int16", "var", "VAR_SF", ""},
+	{"VAR_SF", 30, "sunssf", "", "", ""},
+	{"PF", 31, "int16", "%", "PF_SF", ""},
+	{"PF_SF", 35, "sunssf", "", "", ""},
+	{"TotWhExp**", 36, "acc32", "Wh", "TotWh_SF", ""},
+	{"TotWhImp**", 44, "acc32", "Wh", "TotWh_SF", ""},
+	{"TotWh_SF", 52, "sunssf", "", "", ""},
+}
+
+// The MPPT model 160 has a fixed block followed by one block per input.
+var sunSpecMPPTFixed = []sunSpecPoint{
+	{"DCA_SF", 0, "sunssf", "", "", ""},
+	{"DCV_SF", 1, "sunssf", "", "", ""},
+	{"DCW_SF", 2, "sunssf", "", "", ""},
+	{"DCWH_SF", 3, "sunssf", "", "", ""},
+}
+
+var sunSpecMPPTModule = []sunSpecPoint{
+	{"DCA", 9, "uint16", "A", "DCA_SF", ""},
+	{"DCV", 10, "uint16", "V", "DCV_SF", ""},
+	{"DCW", 11, "uint16", "W", "DCW_SF", ""},
+	{"DCWH", 12, "acc32", "Wh", "DCWH_SF", ""},
+	{"Tmp", 16, "int16", "C", "", ""},
+}
+
+const (
+	sunSpecMPPTFixedLen  = 8
+	sunSpecMPPTModuleLen = 20
+)
+
+// DiscoverSunSpec looks for the SunSpec marker, walks the model chain and
+// builds registers for the common models (101-103 inverters, 160 MPPT,
+// 201-204 meters). Points the device reports as not implemented are left
+// out, scale factors are read with the registers and applied to them.
+func DiscoverSunSpec(t Transport, cfg *Config) ([]*Register, *SunSpecDevice, error) {
+	dev := &SunSpecDevice{}
+
+	found := false
+	for _, base := range SunSpecBases {
+		raw, err := t.Read(base, 2)
+		if err == nil && len(raw) == 4 && binary.BigEndian.Uint32(raw) == sunSpecMarker {
+			dev.Base, found = base, true
+			break
+		}
+	}
+	if !found {
+		return nil, nil, errors.New("no SunSpec marker found")
+	}
+
+	var registers []*Register
+	addr := dev.Base + 2
+	for n := 0; n < 64; n++ {
+		hdr, err := t.Read(addr, 2)
+		if err != nil {
+			return nil, nil, fmt.Errorf("sunspec model header at %d: %v", addr, err)
+		}
+
+		id, length := binary.BigEndian.Uint16(hdr), binary.BigEndian.Uint16(hdr[2:])
+		if id == 0xFFFF || length == 0 {
+			break
+		}
+		m := SunSpecModel{ID: id, Addr: addr, Length: length}
+		dev.Models = append(dev.Models, m)
+
+		regs, err := sunSpecModelRegisters(t, cfg, dev, m)
+		if err != nil {
+			return nil, nil, err
+		}
+		registers = append(registers, regs...)
+
+		addr += 2 + length
+	}
+
+	if len(registers) == 0 {
+		return nil, dev, fmt.Errorf("sunspec: no supported model in %s", dev)
+	}
+
+	// Scale factors first, the points read them while being parsed
+	var sfs, points []*Register
+	for _, r := range registers {
+		if r.vtype == "I16" && r.TsType == "none" && strings.HasSuffix(r.name, "_SF") {
+			sfs = append(sfs, r)
+		} else {
+			points = append(points, r)
+		}
+	}
+	return append(sfs, points...), dev, nil
+}
+
+// sunSpecModelRegisters reads a model block once and returns registers for
+// its implemented points.
+func sunSpecModelRegisters(t Transport, cfg *Config, dev *SunSpecDevice, m SunSpecModel) ([]*Register, error) {
+	start := m.Addr + 2
+
+	var points []sunSpecPoint
+	var prefix string
+	switch {
+	case m.ID == 1:
+		block, err := readBlock(t, start, m.Length)
+		if err != nil {
+			return nil, err
+		}
+		dev.Manufacturer = sunSpecString(block, 0, 16)
+		dev.Model = sunSpecString(block, 16, 16)
+		dev.Version = sunSpecString(block, 40, 8)
+		dev.Serial = sunSpecString(block, 48, 16)
+		return nil, nil
+	case m.ID >= 101 && m.ID <= 103:
+		points, prefix = sunSpecInverter, "inv"
+	case m.ID >= 201 && m.ID <= 204:
+		points, prefix = sunSpecMeter, "meter"
+	case m.ID == 160:
+		return sunSpecMPPTRegisters(t, cfg, m)
+	default:
+		return nil, nil
+	}
+
+	block, err := readBlock(t, start, m.Length)
+	if err != nil {
+		return nil, err
+	}
+	return sunSpecRegisters(cfg, block, start, 0, prefix, points, make(map[string]*Register)), nil
+}
+
+func sunSpecMPPTRegisters(t Transport, cfg *Config, m SunSpecModel) ([]*Register, error) {
+	start := m.Addr + 2
+	block, err := readBlock(t, start, m.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	// the modules share the scale factors of the fixed block
+	sfs := make(map[string]*Register)
+	registers := sunSpecRegisters(cfg, block, start, 0, "mppt", sunSpecMPPTFixed, sfs)
+	for i := 0; sunSpecMPPTFixedLen+(i+1)*sunSpecMPPTModuleLen <= int(m.Length); i++ {
+		offset := uint16(sunSpecMPPTFixedLen + i*sunSpecMPPTModuleLen)
+		prefix := fmt.Sprintf("mppt%d", i+1)
+		registers = append(registers, sunSpecRegisters(cfg, block, start, offset, prefix, sunSpecMPPTModule, sfs)...)
+	}
+	return registers, nil
+}
+
+// sunSpecRegisters turns points into registers, block holds the model
+// data read at discovery time to leave out unimplemented points. The scale
+// factors found are added to sfs.
+func sunSpecRegisters(cfg *Config, block []byte, start, base uint16, prefix string, points []sunSpecPoint, sfs map[string]*Register) []*Register {
+	// scale factors first, they follow the points using them
+	var ordered []sunSpecPoint
+	for _, p := range points {
+		if p.Type == "sunssf" {
+			ordered = append(ordered, p)
+		}
+	}
+	for _, p := range points {
+		if p.Type != "sunssf" {
+			ordered = append(ordered, p)
+		}
+	}
+
+	var registers []*Register
+	for _, p := range ordered {
+		off := int(base + p.Offset)
+		size := 1
+		vtype := "U16"
+		switch p.Type {
+		case "int16", "sunssf":
+			vtype = "I16"
+		case "acc32", "uint32", "bitfield32":
+			size, vtype = 2, "U32"
+		}
+
+		if (off+size)*2 > len(block) || sunSpecNotImplemented(p.Type, block[off*2:(off+size)*2]) {
+			continue
+		}
+
+		r := NewRegister()
+		r.id = uint64(start) + uint64(off)
+		r.bytesCnt = uint64(size)
+		r.name = prefix + "_" + p.Name
+		r.gain = 1
+		r.vtype = vtype
+		r.unit = p.Unit
+		if r.unit == "" {
+			r.unit = "_"
+		}
+		r.disableAfter = cfg.DisableAfter
+		r.MName = cfg.DefaultMName
+		r.TsType = cfg.DefaultTsType
+		if p.Type == "sunssf" {
+			r.TsType = "none"
+		}
+		r.align, _ = ParseAlignment(r.TsType)
+		if p.Codes != "" {
+			r.codes = BuiltinCodeTables[p.Codes]
+		}
+		if p.SF != "" {
+			// a missing scale factor leaves the point out, its value would be wrong
+			sf, ok := sfs[p.SF]
+			if !ok {
+				continue
+			}
+			r.scale = sf
+		}
+
+		if p.Type == "sunssf" {
+			sfs[p.Name] = r
+		}
+		registers = append(registers, r)
+	}
+	return registers
+}
+
+func readBlock(t Transport, start, length uint16) ([]byte, error) {
+	var block []byte
+	for read := uint16(0); read < length; {
+		n := length - read
+		if n > 125 {
+			n = 125
+		}
+		raw, err := t.Read(start+read, n)
+		if err != nil {
+			return nil, fmt.Errorf("sunspec model at %d: %v", start-2, err)
+		}
+		block = append(block, raw...)
+		read += n
+	}
+	return block, nil
+}
+
+// sunSpecNotImplemented reports the SunSpec "not implemented" values.
+func sunSpecNotImplemented(typ string, raw []byte) bool {
+	switch typ {
+	case "int16", "sunssf":
+		return binary.BigEndian.Uint16(raw) == 0x8000
+	case "uint16", "enum16", "bitfield16":
+		return binary.BigEndian.Uint16(raw) == 0xFFFF
+	case "acc32":
+		return binary.BigEndian.Uint32(raw) == 0
+	case "uint32", "bitfield32":
+		return binary.BigEndian.Uint32(raw) == 0xFFFFFFFF
+	}
+	return false
+}
+
+func sunSpecString(block []byte, offset, length int) string {
+	if (offset+length)*2 > len(block) {
+		return ""
+	}
+	return strings.TrimRight(string(block[offset*2:(offset+length)*2]), "\x00 ")
+}
@@ -0,0 +1,148 @@
+package solarmon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// ServerTLSConfig returns the TLS config of the HTTP listener, nil when
+// TLS is off. With -HTTPSelfSigned a certificate is generated and, when
+// -HTTPCert and -HTTPKey are set, kept there for the next start.
+func ServerTLSConfig(cfg *Config) (*tls.Config, string, error) {
+	if !cfg.HTTPSelfSigned && cfg.HTTPCert == "" && cfg.HTTPKey == "" {
+		return nil, "", nil
+	}
+	if (cfg.HTTPCert == "") != (cfg.HTTPKey == "") {
+		return nil, "", errors.New("-HTTPCert and -HTTPKey go together")
+	}
+
+	if cfg.HTTPSelfSigned && !fileExists(cfg.HTTPCert) {
+		certPEM, keyPEM, err := selfSignedCert(time.Now())
+		if err != nil {
+			return nil, "", err
+		}
+		if cfg.HTTPCert != "" {
+			if err := ioutil.WriteFile(cfg.HTTPKey, keyPEM, 0600); err != nil {
+				return nil, "", err
+			}
+			if err := ioutil.WriteFile(cfg.HTTPCert, certPEM, 0644); err != nil {
+				return nil, "", err
+			}
+		}
+		return serverTLS(certPEM, keyPEM)
+	}
+
+	certPEM, err := ioutil.ReadFile(cfg.HTTPCert)
+	if err != nil {
+		return nil, "", err
+	}
+	keyPEM, err := ioutil.ReadFile(cfg.HTTPKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return serverTLS(certPEM, keyPEM)
+}
+
+// serverTLS also returns the SHA-256 fingerprint of the certificate, for
+// clients pinning a self signed one.
+func serverTLS(certPEM, keyPEM []byte) (*tls.Config, string, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid TLS certificate: %v", err)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, hex.EncodeToString(sum[:]), nil
+}
+
+// selfSignedCert makes a 10 year ECDSA certificate for the host name,
+// localhost and the addresses of the host.
+func selfSignedCert(now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"solarmon"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if host != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// InfluxTLSConfig verifies the influxdb server against the system roots,
+// or the -influxCA bundle when set. -influxInsecure turns verification off.
+func InfluxTLSConfig(cfg *Config) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: cfg.InfluxInsecure}
+	if cfg.InfluxCA == "" {
+		return tc, nil
+	}
+
+	bundle, err := ioutil.ReadFile(cfg.InfluxCA)
+	if err != nil {
+		return nil, err
+	}
+	tc.RootCAs = x509.NewCertPool()
+	if !tc.RootCAs.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("-influxCA %s: no PEM certificates found", cfg.InfluxCA)
+	}
+	return tc, nil
+}
+
+func fileExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,189 @@
+package solarmon
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	sysClassTTY = "/sys/class/tty"
+	devSerialID = "/dev/serial/by-id"
+)
+
+// TTYCandidate is a USB serial adapter as seen in sysfs.
+type TTYCandidate struct {
+	Device       string
+	ByID         []string
+	SysfsPath    string
+	VID          string
+	PID          string
+	Serial       string
+	Manufacturer string
+	Product      string
+}
+
+func (c TTYCandidate) String() string {
+	return fmt.Sprintf(
+		"%s vidpid=%s:%s serial=%q manufacturer=%q product=%q sysfs=%s by-id=%s",
+		c.Device, c.VID, c.PID, c.Serial, c.Manufacturer, c.Product, c.SysfsPath, strings.Join(c.ByID, ","),
+	)
+}
+
+// ListTTYCandidates returns the ttyUSB* and ttyACM* devices with the
+// attributes of the USB device behind them, sorted by device name.
+func ListTTYCandidates() ([]TTYCandidate, error) {
+	files, err := ioutil.ReadDir(sysClassTTY)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string][]string)
+	if links, err := ioutil.ReadDir(devSerialID); err == nil {
+		for _, l := range links {
+			target, err := filepath.EvalSymlinks(filepath.Join(devSerialID, l.Name()))
+			if err == nil {
+				byID[target] = append(byID[target], l.Name())
+			}
+		}
+	}
+
+	var candidates []TTYCandidate
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "ttyUSB") && !strings.HasPrefix(f.Name(), "ttyACM") {
+			continue
+		}
+
+		c := TTYCandidate{Device: "/dev/" + f.Name()}
+		c.ByID = byID[c.Device]
+
+		if dir, err := usbDeviceDir(f.Name()); err == nil {
+			c.SysfsPath = dir
+			c.VID = readSysfsAttr(dir, "idVendor")
+			c.PID = readSysfsAttr(dir, "idProduct")
+			c.Serial = readSysfsAttr(dir, "serial")
+			c.Manufacturer = readSysfsAttr(dir, "manufacturer")
+			c.Product = readSysfsAttr(dir, "product")
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Device < candidates[j].Device })
+	return candidates, nil
+}
+
+// Match checks the candidate against a selector: comma separated criteria
+// that must all match, each one of
+//
+//	by-id:<name or glob>   entry in /dev/serial/by-id, or its full path
+//	vidpid:<vid>:<pid>     USB vendor and product id, e.g. 1a86:7523
+//	serial:<serial>        USB serial number
+//	sysfs:<glob>           sysfs path of the USB device, e.g. */1-1.3
+//
+// A glob without a leading slash matches the end of the path.
+func (c TTYCandidate) Match(selector string) (bool, error) {
+	for _, criterion := range strings.Split(selector, ",") {
+		criterion = strings.TrimSpace(criterion)
+		if criterion == "" {
+			continue
+		}
+
+		kv := strings.SplitN(criterion, ":", 2)
+		if len(kv) != 2 {
+			return false, fmt.Errorf("invalid tty selector %q", criterion)
+		}
+
+		var ok bool
+		var err error
+		switch kv[0] {
+		case "by-id":
+			for _, name := range c.ByID {
+				if ok, err = matchPath(kv[1], filepath.Join(devSerialID, name)); ok || err != nil {
+					break
+				}
+			}
+		case "vidpid":
+			ok = strings.EqualFold(kv[1], c.VID+":"+c.PID)
+		case "serial":
+			ok = c.Serial != "" && kv[1] == c.Serial
+		case "sysfs":
+			ok, err = matchPath(kv[1], c.SysfsPath)
+		default:
+			err = fmt.Errorf("unknown tty selector %q", kv[0])
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchPath matches an absolute pattern against the whole path and a
+// relative one against as many trailing elements of path as it has, a
+// star never crosses a slash.
+func matchPath(pattern, path string) (bool, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		n := strings.Count(pattern, "/") + 1
+		elems := strings.Split(path, "/")
+		if n > len(elems) {
+			return filepath.Match(pattern, "")
+		}
+		path = strings.Join(elems[len(elems)-n:], "/")
+	}
+	return filepath.Match(pattern, path)
+}
+
+// FindTTY returns the first candidate matching selector, an empty selector
+// matches the first ttyUSB* device.
+func FindTTY(selector string) (string, error) {
+	if selector == "" {
+		return getTTYUSBdevicePath()
+	}
+
+	candidates, err := ListTTYCandidates()
+	if err != nil {
+		return "", err
+	}
+
+	for _, c := range candidates {
+		ok, err := c.Match(selector)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return c.Device, nil
+		}
+	}
+	return "", fmt.Errorf("no tty matches %q", selector)
+}
+
+// usbDeviceDir walks up from the tty device in sysfs to the USB device, the
+// first directory holding idVendor. ttyUSB devices sit two levels below it
+// (usb-serial port, interface), ttyACM devices one level.
+func usbDeviceDir(tty string) (string, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysClassTTY, filepath.Base(tty), "device"))
+	if err != nil {
+		return "", err
+	}
+
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", errors.New("not a usb device")
+}
+
+func readSysfsAttr(dir, name string) string {
+	content, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
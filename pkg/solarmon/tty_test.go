@@ -0,0 +1,42 @@
+package solarmon
+
+import "testing"
+
+func TestTTYCandidateMatch(t *testing.T) {
+	c := TTYCandidate{
+		Device:    "/dev/ttyUSB0",
+		ByID:      []string{"usb-1a86_USB_Serial-if00-port0"},
+		SysfsPath: "/sys/devices/platform/soc/3f980000.usb/usb1/1-1/1-1.3",
+		VID:       "1a86",
+		PID:       "7523",
+		Serial:    "A50285BI",
+	}
+
+	tests := []struct {
+		selector string
+		want     bool
+		err      bool
+	}{
+		{"by-id:usb-1a86_*", true, false},
+		{"by-id:usb-0403_*", false, false},
+		{"by-id:/dev/serial/by-id/usb-1a86_USB_Serial-if00-port0", true, false},
+		{"by-id:/dev/serial/by-id/usb-1a86_*", true, false},
+		{"by-id:/dev/usb-1a86_*", false, false},
+		{"by-id:by-id/usb-1a86_*", true, false},
+		{"sysfs:1-1.3", true, false},
+		{"sysfs:/sys/devices/*/1-1.3", false, false},
+		{"vidpid:1A86:7523", true, false},
+		{"sysfs:*/1-1.3,serial:A50285BI", true, false},
+		{"sysfs:*/1-1.3,serial:other", false, false},
+		{"by-id:[", false, true},
+		{"usb:1a86", false, true},
+		{"vidpid", false, true},
+	}
+
+	for _, tt := range tests {
+		got, err := c.Match(tt.selector)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("%s: got %v, %v, want %v, error %v", tt.selector, got, err, tt.want, tt.err)
+		}
+	}
+}
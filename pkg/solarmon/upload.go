@@ -0,0 +1,200 @@
+package solarmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+// FuncCodeHuaweiExtended is the Huawei extended function used by SUN2000
+// inverters to upload files (history data, logs) to the master.
+const FuncCodeHuaweiExtended = 0x41
+
+// MaxUploadSize caps the file size an inverter can announce, a corrupt
+// start answer must not make us reserve gigabytes.
+const MaxUploadSize = 4 << 20
+
+// Sub-functions of the file upload, every request and response is
+//
+//	sub-function, data length, data
+const (
+	uploadStart    = 0x05
+	uploadData     = 0x06
+	uploadComplete = 0x0C
+)
+
+// FileUploader is implemented by transports able to send a Huawei extended
+// function request. req and the returned response are the PDU data after
+// the function code.
+type FileUploader interface {
+	Upload(req []byte) ([]byte, error)
+}
+
+// UploadFile pulls a whole file of fileType:
+//
+//	start:    05 01 type                 -> 05 06 type length(4) frame size(1)
+//	data:     06 03 type frame(2)        -> 06 n type frame(2) data
+//	complete: 0C 01 type                 -> 0C 03 type crc(2)
+//
+// The crc is the Modbus CRC16 of the file.
+func UploadFile(t Transport, fileType byte) ([]byte, error) {
+	u, ok := t.(FileUploader)
+	if !ok {
+		return nil, errors.New("the transport can not upload files")
+	}
+
+	resp, err := uploadRequest(u, uploadStart, fileType)
+	if err != nil {
+		return nil, fmt.Errorf("file 0x%02X start: %w", fileType, err)
+	}
+	if len(resp) < 6 {
+		return nil, fmt.Errorf("file 0x%02X start: short answer % x", fileType, resp)
+	}
+	size := int(binary.BigEndian.Uint32(resp[1:]))
+	frameSize := int(resp[5])
+	if frameSize == 0 {
+		return nil, fmt.Errorf("file 0x%02X start: zero frame size", fileType)
+	}
+	if size > MaxUploadSize {
+		return nil, fmt.Errorf("file 0x%02X start: size %d above the %d limit", fileType, size, MaxUploadSize)
+	}
+
+	// grown as frames arrive, the size is only the device's word
+	var file []byte
+	for frame := 0; len(file) < size; frame++ {
+		resp, err := uploadRequest(u, uploadData, fileType, byte(frame>>8), byte(frame))
+		if err != nil {
+			return nil, fmt.Errorf("file 0x%02X frame %d: %w", fileType, frame, err)
+		}
+		if len(resp) < 4 || int(binary.BigEndian.Uint16(resp[1:])) != frame {
+			return nil, fmt.Errorf("file 0x%02X frame %d: unexpected answer % x", fileType, frame, resp)
+		}
+		data := resp[3:]
+		if len(data) == 0 {
+			return nil, fmt.Errorf("file 0x%02X frame %d: no data", fileType, frame)
+		}
+		file = append(file, data...)
+	}
+	file = file[:size]
+
+	resp, err = uploadRequest(u, uploadComplete, fileType)
+	if err != nil {
+		return nil, fmt.Errorf("file 0x%02X complete: %w", fileType, err)
+	}
+	if len(resp) >= 3 && binary.BigEndian.Uint16(resp[1:]) != crc16(file) {
+		return nil, fmt.Errorf("file 0x%02X: crc mismatch", fileType)
+	}
+	return file, nil
+}
+
+// uploadRequest sends sub-function sub with data and returns the answer
+// data after its sub-function and length.
+func uploadRequest(u FileUploader, sub byte, data ...byte) ([]byte, error) {
+	req := append([]byte{sub, byte(len(data))}, data...)
+	resp, err := u.Upload(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || resp[0] != sub || int(resp[1]) != len(resp)-2 {
+		return nil, &BusError{Class: ErrClassFraming, Op: OpUpload, Err: fmt.Errorf("bad upload answer % x", resp)}
+	}
+	return resp[2:], nil
+}
+
+// uploadPDU runs req through a packager and transporter, for transports
+// whose framing does not depend on the function code.
+func uploadPDU(h modbus.ClientHandler, req []byte) ([]byte, error) {
+	adu, err := h.Encode(&modbus.ProtocolDataUnit{FunctionCode: FuncCodeHuaweiExtended, Data: req})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.Send(adu)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.Verify(adu, resp); err != nil {
+		return nil, err
+	}
+	pdu, err := h.Decode(resp)
+	if err != nil {
+		return nil, err
+	}
+	return uploadAnswer(pdu)
+}
+
+func uploadAnswer(pdu *modbus.ProtocolDataUnit) ([]byte, error) {
+	if pdu.FunctionCode == FuncCodeHuaweiExtended|0x80 && len(pdu.Data) > 0 {
+		return nil, &modbus.ModbusError{FunctionCode: pdu.FunctionCode, ExceptionCode: pdu.Data[0]}
+	}
+	if pdu.FunctionCode != FuncCodeHuaweiExtended {
+		return nil, fmt.Errorf("unexpected function 0x%02X", pdu.FunctionCode)
+	}
+	return pdu.Data, nil
+}
+
+// rtuUpload sends req over its own connection to the serial port: the
+// vendored RTU transporter sizes answers by function code and would cut
+// the upload frames short. The handler reopens the port on its next read.
+func rtuUpload(h *modbus.RTUClientHandler, req []byte) ([]byte, error) {
+	h.Close()
+
+	port, err := serial.Open(&h.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer port.Close()
+
+	adu, err := h.Encode(&modbus.ProtocolDataUnit{FunctionCode: FuncCodeHuaweiExtended, Data: req})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = port.Write(adu); err != nil {
+		return nil, err
+	}
+
+	// slave, function and sub-function (or exception code), answers carry
+	// their data length next
+	resp := make([]byte, 4, 261)
+	if _, err = io.ReadFull(port, resp[:3]); err != nil {
+		return nil, err
+	}
+	n, size := 3, 5
+	if resp[1] == FuncCodeHuaweiExtended {
+		if _, err = io.ReadFull(port, resp[3:4]); err != nil {
+			return nil, err
+		}
+		n, size = 4, 4+int(resp[3])+2
+	}
+	resp = resp[:size]
+	if _, err = io.ReadFull(port, resp[n:]); err != nil {
+		return nil, err
+	}
+
+	if err = h.Verify(adu, resp); err != nil {
+		return nil, err
+	}
+	pdu, err := h.Decode(resp)
+	if err != nil {
+		return nil, err
+	}
+	return uploadAnswer(pdu)
+}
+
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,54 @@
+package solarmon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// fileDevice answers the upload requests for file, announcing size and
+// sending frames of frameSize bytes.
+type fileDevice struct {
+	file      []byte
+	size      uint32
+	frameSize int
+}
+
+func (d *fileDevice) Upload(req []byte) ([]byte, error) {
+	var data []byte
+	switch req[0] {
+	case uploadStart:
+		data = []byte{req[2], 0, 0, 0, 0, byte(d.frameSize)}
+		binary.BigEndian.PutUint32(data[1:], d.size)
+	case uploadData:
+		frame := int(binary.BigEndian.Uint16(req[3:]))
+		start := frame * d.frameSize
+		end := start + d.frameSize
+		if end > len(d.file) {
+			end = len(d.file)
+		}
+		data = append([]byte{req[2], req[3], req[4]}, d.file[start:end]...)
+	case uploadComplete:
+		data = []byte{req[2], 0, 0}
+		binary.BigEndian.PutUint16(data[1:], crc16(d.file))
+	}
+	return append([]byte{req[0], byte(len(data))}, data...), nil
+}
+
+func (d *fileDevice) Read(id uint16, cnt uint16) ([]byte, error) { return nil, nil }
+
+func (d *fileDevice) Close() {}
+
+func TestUploadFile(t *testing.T) {
+	file := bytes.Repeat([]byte("history "), 100)
+	got, err := UploadFile(&fileDevice{file: file, size: uint32(len(file)), frameSize: 240}, 0x03)
+	if err != nil || !bytes.Equal(got, file) {
+		t.Errorf("got %d bytes %v, want the %d byte file", len(got), err, len(file))
+	}
+
+	_, err = UploadFile(&fileDevice{file: file, size: 0xFFFFFFFF, frameSize: 240}, 0x03)
+	if err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("announced 4GiB: got %v, want the size refused", err)
+	}
+}
@@ -0,0 +1,195 @@
+package solarmon
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validation holds the sanity rules of a register, set with an rfile line
+//
+//	%check:register:rule,rule...
+//
+// Rules are min=N, max=N, rate=N[/s|/m|/h] (largest change per unit of
+// time), counter[=h|d|m|y] (must not decrease, except when the given hour,
+// day, month or year boundary of the site timezone passed since the last
+// accepted reading) and invalid[=v|v...] (raw values meaning "not
+// available", the type defaults when no values are given).
+type Validation struct {
+	min, max     float64
+	hasMin       bool
+	hasMax       bool
+	rate         float64
+	counter      bool
+	resetsEvery  string
+	invalid      []uint64
+	checkInvalid bool
+	loc          *time.Location
+
+	last     float64
+	lastTs   time.Time
+	rejected int
+}
+
+// rebaseAfter consecutive rate or counter rejections make the next reading
+// the new reference, so one bad reading can not block a register forever.
+const rebaseAfter = 3
+
+// invalidSentinels are the "no data" values the SUN2000 uses per type.
+var invalidSentinels = map[string][]uint64{
+	"I16": {0x7FFF, 0x8000},
+	"U16": {0xFFFF},
+	"I32": {0x7FFFFFFF, 0x80000000},
+	"U32": {0xFFFFFFFF},
+}
+
+// ParseValidation parses the rules of a %check line, counter boundaries
+// are taken in loc, the local timezone when nil.
+func ParseValidation(rules string, loc *time.Location) (*Validation, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	v := &Validation{loc: loc}
+	for _, rule := range strings.Split(rules, ",") {
+		kv := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		arg := ""
+		if len(kv) == 2 {
+			arg = kv[1]
+		}
+
+		var err error
+		switch kv[0] {
+		case "min":
+			v.min, err = strconv.ParseFloat(arg, 64)
+			v.hasMin = true
+		case "max":
+			v.max, err = strconv.ParseFloat(arg, 64)
+			v.hasMax = true
+		case "rate":
+			v.rate, err = parseRate(arg)
+		case "counter":
+			v.counter = true
+			v.resetsEvery = arg
+			switch arg {
+			case "", "h", "d", "m", "y":
+			default:
+				err = errors.New("reset boundary must be h, d, m or y")
+			}
+		case "invalid":
+			v.checkInvalid = true
+			for _, s := range strings.Split(arg, "|") {
+				if s == "" {
+					continue
+				}
+				var x uint64
+				if x, err = strconv.ParseUint(s, 0, 64); err != nil {
+					break
+				}
+				v.invalid = append(v.invalid, x)
+			}
+		default:
+			err = errors.New("unknown rule")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid check %q: %v", rule, err)
+		}
+	}
+	return v, nil
+}
+
+// parseRate returns the rate per second of "N", "N/s", "N/m" or "N/h".
+func parseRate(s string) (float64, error) {
+	per := time.Second
+	if i := strings.Index(s, "/"); i >= 0 {
+		switch s[i+1:] {
+		case "s":
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return 0, fmt.Errorf("unknown rate unit %s", s[i+1:])
+		}
+		s = s[:i]
+	}
+
+	x, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return x / per.Seconds(), nil
+}
+
+// Check tests a reading and, when accepted, remembers it for the rate and
+// counter rules. code is the undecoded register content.
+func (v *Validation) Check(vtype string, code uint64, value float64, ts time.Time) error {
+	if v.checkInvalid {
+		invalid := v.invalid
+		if len(invalid) == 0 {
+			invalid = invalidSentinels[vtype]
+		}
+		for _, x := range invalid {
+			if code == x {
+				return fmt.Errorf("invalid value 0x%X", code)
+			}
+		}
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("invalid value %v", value)
+	}
+
+	if v.hasMin && value < v.min {
+		return fmt.Errorf("value %v below min %v", value, v.min)
+	}
+
+	if v.hasMax && value > v.max {
+		return fmt.Errorf("value %v above max %v", value, v.max)
+	}
+
+	if !v.lastTs.IsZero() && v.rejected < rebaseAfter {
+		delta := value - v.last
+		reset := v.counter && delta < 0 && v.crossedBoundary(ts)
+
+		if v.counter && delta < 0 && !reset {
+			v.rejected++
+			return fmt.Errorf("counter decreased from %v to %v", v.last, value)
+		}
+
+		if v.rate > 0 && !reset {
+			dt := ts.Sub(v.lastTs).Seconds()
+			if math.Abs(delta) > v.rate*math.Max(dt, 1) {
+				v.rejected++
+				return fmt.Errorf("value changed from %v to %v in %.0fs", v.last, value, dt)
+			}
+		}
+	}
+
+	v.rejected = 0
+	v.last = value
+	v.lastTs = ts
+	return nil
+}
+
+// crossedBoundary reports whether the counter reset boundary passed
+// between the last accepted reading and ts, in the site timezone like the
+// energy periods and alignment.
+func (v *Validation) crossedBoundary(ts time.Time) bool {
+	prev, ts := v.lastTs.In(v.loc), ts.In(v.loc)
+	switch v.resetsEvery {
+	case "h":
+		return ts.Sub(prev) >= time.Hour || prev.Hour() != ts.Hour()
+	case "d":
+		return prev.YearDay() != ts.YearDay() || prev.Year() != ts.Year()
+	case "m":
+		return prev.Month() != ts.Month() || prev.Year() != ts.Year()
+	case "y":
+		return prev.Year() != ts.Year()
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package solarmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterResetInSiteZone(t *testing.T) {
+	site := time.FixedZone("site", 3*3600)
+	// 23:50 and 00:10 at the site, the same UTC day
+	before := time.Date(2024, 6, 1, 20, 50, 0, 0, time.UTC)
+	after := before.Add(20 * time.Minute)
+
+	for _, tt := range []struct {
+		loc   *time.Location
+		reset bool
+	}{
+		{loc: site, reset: true},
+		{loc: time.UTC, reset: false},
+	} {
+		v, err := ParseValidation("counter=d", tt.loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Check("U32", 4200, 42, before); err != nil {
+			t.Fatal(err)
+		}
+		err = v.Check("U32", 10, 0.1, after)
+		if tt.reset && err != nil {
+			t.Errorf("%s: got %v, want the daily reset accepted", tt.loc, err)
+		}
+		if !tt.reset && err == nil {
+			t.Errorf("%s: got the decrease accepted, want it rejected", tt.loc)
+		}
+	}
+}